@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+func validLogFormat(format string) error {
+	switch format {
+	case "", "clf", "combined":
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("invalid -log-format %q, must be clf or combined", format))
+}
+
+type accessLogKey struct{}
+
+// filled in as the request makes its way through, for
+// the access log line written once it's done
+type accessEntry struct {
+	cache string
+}
+
+// records how the cache answered req, if anything is
+// logging it
+func noteCacheStatus(req *http.Request, status string) {
+	if e, ok := req.Context().Value(accessLogKey{}).(*accessEntry); ok {
+		e.cache = status
+	}
+}
+
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessLogWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessLogWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+
+	n, err := aw.ResponseWriter.Write(b)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// Apache style access logs to w, one line a request, for
+// tools that already read them. combined adds the
+// referer and user agent, then how long the request took
+// in seconds and how the cache answered it
+func accessLog(format string, w io.Writer, next http.Handler) http.Handler {
+	logger := log.New(w, "", 0)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{cache: "-"}
+		aw := &accessLogWriter{ResponseWriter: rw}
+
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+			clientHost(r.RemoteAddr),
+			logUser(r),
+			start.Format(clfTime),
+			logQuote(r.Method), logQuote(r.RequestURI), logQuote(r.Proto),
+			status,
+			logBytes(aw.bytes))
+
+		if format == "combined" {
+			line += fmt.Sprintf(" \"%s\" \"%s\" %.3f %s",
+				logField(r.Referer()),
+				logField(r.UserAgent()),
+				time.Since(start).Seconds(),
+				entry.cache)
+		}
+
+		logger.Println(line)
+	})
+}
+
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+func logUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return logQuote(strings.ReplaceAll(user, " ", "_"))
+	}
+
+	return "-"
+}
+
+// CLF has - for no body rather than 0
+func logBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+
+	return strconv.FormatInt(n, 10)
+}
+
+func logField(v string) string {
+	if v == "" {
+		return "-"
+	}
+
+	return logQuote(v)
+}
+
+// nothing a client sends should be able to end a field or
+// a line early
+func logQuote(v string) string {
+	q := strconv.Quote(v)
+	return q[1 : len(q)-1]
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	clfLine      = regexp.MustCompile(`^(\S+) - (\S+) \[([^\]]+)\] "([^"]*)" (\d{3}) (\S+)$`)
+	combinedLine = regexp.MustCompile(`^(.+) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)" (\d+\.\d{3}) (\S+)$`)
+)
+
+// serves body with status, noting cache as the cache status
+// the way the proxy does
+func logged(t *testing.T, format string, status int, body, cache string, r *http.Request) string {
+	var out bytes.Buffer
+	handler := accessLog(format, &out, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if cache != "" {
+			noteCacheStatus(r, cache)
+		}
+
+		rw.WriteHeader(status)
+		io.WriteString(rw, body)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := strings.TrimSuffix(out.String(), "\n")
+	if strings.Contains(line, "\n") {
+		t.Fatal(fmt.Sprintf("logged more than one line: %q", out.String()))
+	}
+
+	return line
+}
+
+func logRequest(target string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = "192.0.2.7:51234"
+	return r
+}
+
+func TestCommonLogLine(t *testing.T) {
+	r := logRequest("/a/b?c=d")
+	r.SetBasicAuth("jane doe", "secret")
+
+	before := time.Now().Truncate(time.Second)
+	line := logged(t, "clf", http.StatusCreated, "hello", "", r)
+
+	m := clfLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatal(fmt.Sprintf("%q isn't a CLF line", line))
+	}
+
+	if m[1] != "192.0.2.7" || m[2] != "jane_doe" {
+		t.Fatal(fmt.Sprintf("host %q and user %q", m[1], m[2]))
+	}
+
+	at, err := time.Parse(clfTime, m[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if at.Before(before) || at.After(time.Now()) {
+		t.Fatal(fmt.Sprintf("logged at %s, not when it was served", at))
+	}
+
+	if m[4] != "GET /a/b?c=d HTTP/1.1" || m[5] != "201" || m[6] != "5" {
+		t.Fatal(fmt.Sprintf("request %q, status %s, bytes %s", m[4], m[5], m[6]))
+	}
+}
+
+func TestCommonLogLineWithoutUserOrBody(t *testing.T) {
+	line := logged(t, "clf", http.StatusNoContent, "", "", logRequest("/"))
+
+	m := clfLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatal(fmt.Sprintf("%q isn't a CLF line", line))
+	}
+
+	if m[2] != "-" || m[5] != "204" || m[6] != "-" {
+		t.Fatal(fmt.Sprintf("user %q, status %s, bytes %q rather than -, 204, -", m[2], m[5], m[6]))
+	}
+}
+
+func TestCombinedLogLine(t *testing.T) {
+	r := logRequest("/page")
+	r.Header.Set("Referer", "https://example.com/")
+	r.Header.Set("User-Agent", `agent "quoted"`+"\nforged line")
+
+	line := logged(t, "combined", http.StatusOK, "hi", "hit", r)
+
+	m := combinedLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatal(fmt.Sprintf("%q isn't a combined line", line))
+	}
+
+	if clfLine.FindStringSubmatch(m[1]) == nil {
+		t.Fatal(fmt.Sprintf("%q doesn't start with a CLF line", line))
+	}
+
+	if m[2] != "https://example.com/" || m[3] != `agent \"quoted\"\nforged line` {
+		t.Fatal(fmt.Sprintf("referer %q and user agent %q", m[2], m[3]))
+	}
+
+	if m[5] != "hit" {
+		t.Fatal(fmt.Sprintf("cache status %q rather than hit", m[5]))
+	}
+}
+
+func TestCombinedLogLineWithoutCacheStatus(t *testing.T) {
+	line := logged(t, "combined", http.StatusOK, "hi", "", logRequest("/"))
+
+	m := combinedLine.FindStringSubmatch(line)
+	if m == nil {
+		t.Fatal(fmt.Sprintf("%q isn't a combined line", line))
+	}
+
+	// nothing cached it, and there was no referer or agent
+	if m[2] != "-" || m[3] != "-" || m[5] != "-" {
+		t.Fatal(fmt.Sprintf("%q should have - for the empty fields", line))
+	}
+}
+
+func TestLogFormatRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "clf", "combined"} {
+		if err := validLogFormat(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, v := range []string{"json", "CLF", "common"} {
+		if err := validLogFormat(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
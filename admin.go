@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// admin endpoints sit in front of the proxy on the same
+// address and are only mounted when a token is given
+type adminServer struct {
+	o      *options
+	cache  *Cache
+	proxy  http.Handler
+	purger *purger
+	routes map[string]http.HandlerFunc
+}
+
+func newAdminServer(o *options, cache *Cache, proxy http.Handler) http.Handler {
+	if *o.AdminToken == "" {
+		return proxy
+	}
+
+	a := &adminServer{
+		o:      o,
+		cache:  cache,
+		proxy:  proxy,
+		routes: make(map[string]http.HandlerFunc),
+	}
+
+	if cache != nil {
+		a.purger = &purger{cache: cache}
+		a.routes["/_cache/purge"] = a.purge
+		a.routes["/_cache/prime"] = a.prime
+		a.routes["/_cache/inflight"] = a.inflight
+		a.routes["/_metrics"] = a.metrics
+		a.routes["/_metrics/reset"] = a.resetMetrics
+	}
+
+	return a
+}
+
+func (a *adminServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	route := a.routes[r.URL.Path]
+	if route == nil {
+		a.proxy.ServeHTTP(rw, r)
+		return
+	}
+
+	token := []byte("Bearer " + *a.o.AdminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	route(rw, r)
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// records what the proxy would have sent without keeping
+// the body
+type primeWriter struct {
+	header http.Header
+	status int
+	size   int64
+}
+
+func (pw *primeWriter) Header() http.Header {
+	return pw.header
+}
+
+func (pw *primeWriter) WriteHeader(status int) {
+	if pw.status == 0 {
+		pw.status = status
+	}
+}
+
+func (pw *primeWriter) Write(b []byte) (int, error) {
+	pw.WriteHeader(http.StatusOK)
+	pw.size += int64(len(b))
+	return len(b), nil
+}
+
+// POST /_cache/prime?url=/some/path warms an entry by
+// sending a GET for it through the proxy as any client
+// would, so the usual cacheability rules still apply
+func (a *adminServer) prime(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ref, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || ref.Path == "" {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "a url to prime is required"})
+		return
+	}
+
+	host := r.Host
+	if ref.Host != "" {
+		host = ref.Host
+	}
+
+	pw, err := replayGet(r.Context(), a.proxy, ref.RequestURI(), host)
+	if err != nil {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]int64{
+		"status": int64(pw.status),
+		"size":   pw.size,
+	})
+}
+
+// sends a GET for uri through proxy as a client would
+func replayGet(ctx context.Context, proxy http.Handler, uri string, host string) (*primeWriter, error) {
+	in, err := http.NewRequestWithContext(internalRequest(ctx), "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	in.Host = host
+
+	pw := &primeWriter{header: make(http.Header)}
+	proxy.ServeHTTP(pw, in)
+	return pw, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "letmein"
+
+func admin(t *testing.T, method string, u string) (*http.Response, string) {
+	t.Helper()
+	return request(t, method, u, "Authorization", "Bearer "+testAdminToken)
+}
+
+func TestPrimedURLIsAHit(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			rw.Header().Set("Cache-Control", "no-store")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=60")
+		}
+		io.WriteString(rw, "hot content")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-admin-token", testAdminToken)
+
+	res, body := admin(t, "POST", base+"/_cache/prime?url=/hot")
+	if res.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Sprintf("prime got %d, want 200", res.StatusCode))
+	}
+
+	var primed map[string]int64
+	if err := json.Unmarshal([]byte(body), &primed); err != nil {
+		t.Fatal(fmt.Sprintf("prime returned %q, not a status and size: %s", body, err))
+	}
+
+	if primed["status"] != http.StatusOK || primed["size"] != int64(len("hot content")) {
+		t.Fatal(fmt.Sprintf("prime reported %v", primed))
+	}
+
+	if strings.Contains(body, "hot content") {
+		t.Fatal("prime returned the body")
+	}
+
+	if _, body := get(t, base+"/hot"); body != "hot content" {
+		t.Fatal(fmt.Sprintf("got %q after priming", body))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the GET after priming to be a hit", n))
+	}
+
+	// the usual rules still apply
+	admin(t, "POST", base+"/_cache/prime?url=/private")
+	get(t, base+"/private")
+	if n := origin.requests.Load(); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want a no-store response not to be primed", n))
+	}
+}
+
+func TestPrimeNeedsTheAdminToken(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-admin-token", testAdminToken)
+
+	res, _ := request(t, "POST", base+"/_cache/prime?url=/hot", "Authorization", "Bearer wrong")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatal(fmt.Sprintf("got %d, want 401", res.StatusCode))
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal("an unauthorised prime reached the origin")
+	}
+}
+
+func inflightFills(t *testing.T, base string) []inflightFill {
+	t.Helper()
+
+	_, body := admin(t, "GET", base+"/_cache/inflight")
+
+	var fills []inflightFill
+	if err := json.Unmarshal([]byte(body), &fills); err != nil {
+		t.Fatal(fmt.Sprintf("inflight returned %q: %s", body, err))
+	}
+
+	return fills
+}
+
+func TestPendingFetchIsListedAndCanBeCancelled(t *testing.T) {
+	release := make(chan struct{})
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		rw.Header().Set("Cache-Control", "max-age=60")
+	})
+	defer close(release)
+
+	base, _ := newProxy(t, origin.URL, "-c", "-admin-token", testAdminToken)
+
+	if fills := inflightFills(t, base); len(fills) != 0 {
+		t.Fatal(fmt.Sprintf("listed %v before any requests", fills))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := fetch(context.Background(), base+"/stuck")
+		done <- err
+	}()
+
+	var fills []inflightFill
+	waitFor(t, "the fill to be listed", 5*time.Second, func() bool {
+		fills = inflightFills(t, base)
+		return len(fills) == 1
+	})
+
+	if !strings.Contains(fills[0].Key, "/stuck") || fills[0].Pending < 0 {
+		t.Fatal(fmt.Sprintf("listed %+v", fills[0]))
+	}
+
+	res, _ := admin(t, "DELETE", base+"/_cache/inflight?key="+url.QueryEscape(fills[0].Key))
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal(fmt.Sprintf("cancel got %d, want 204", res.StatusCode))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client was still waiting after its fill was cancelled")
+	}
+
+	if fills := inflightFills(t, base); len(fills) != 0 {
+		t.Fatal(fmt.Sprintf("still listed %v after cancelling", fills))
+	}
+
+	res, _ = admin(t, "DELETE", base+"/_cache/inflight?key="+url.QueryEscape(fills[0].Key))
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatal(fmt.Sprintf("cancelling again got %d, want 404", res.StatusCode))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"hash/maphash"
+)
+
+const (
+	sketchDepth          = 4
+	admissionSketchWidth = 1 << 16
+)
+
+// approximate access counts for keys, whether cached or
+// not, in a count-min sketch of small saturating counters.
+// every so often the counts are halved so that what was
+// popular a long time ago fades
+type frequencySketch struct {
+	seed      maphash.Seed
+	width     uint64
+	rows      [sketchDepth][]uint8
+	additions int
+	resetAt   int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	// a power of two so the index is a mask
+	w := uint64(1)
+	for w < uint64(width) {
+		w <<= 1
+	}
+
+	s := &frequencySketch{
+		seed:    maphash.MakeSeed(),
+		width:   w,
+		resetAt: int(w) * 10,
+	}
+
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+
+	return s
+}
+
+// the two halves of one hash are combined to give each
+// row its own index
+func (s *frequencySketch) indexes(key string) [sketchDepth]uint64 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := h&0xffffffff, h>>32
+
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & (s.width - 1)
+	}
+
+	return idx
+}
+
+func (s *frequencySketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j] += 1
+		}
+	}
+
+	s.additions += 1
+	if s.additions >= s.resetAt {
+		s.age()
+	}
+}
+
+func (s *frequencySketch) estimate(key string) uint8 {
+	min := uint8(15)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+
+	return min
+}
+
+func (s *frequencySketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+
+	s.additions /= 2
+}
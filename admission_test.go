@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+)
+
+// a cache of entries requests, with or without admission
+func admissionCache(tb testing.TB, entries int, admission bool) *Cache {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	o := defineFlags(fs)
+
+	args := []string{"-cache-pools", fmt.Sprintf("/=%d:0", entries)}
+	if admission {
+		args = append(args, "-admission")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		tb.Fatal(err)
+	}
+
+	return newCache(o)
+}
+
+// what the proxy does with each request, short of going
+// to an origin. reports whether it was a hit
+func lookup(c *Cache, path string) bool {
+	req := httptest.NewRequest("GET", "http://origin.example"+path, nil)
+	if c.Get(req) != nil {
+		return true
+	}
+
+	c.Create(req, nil).completeUpdate()
+	return false
+}
+
+// popular paths picked by a Zipf distribution, with every
+// other request a path never seen before, as a crawler or
+// a scan would send
+func scanHeavyZipf(seed int64) func() string {
+	r := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(r, 1.1, 1, 100000)
+	scanned := 0
+
+	return func() string {
+		if r.Intn(2) == 0 {
+			scanned++
+			return fmt.Sprintf("/scan/%d", scanned)
+		}
+
+		return fmt.Sprintf("/item/%d", zipf.Uint64())
+	}
+}
+
+func hitRatio(c *Cache, next func() string, requests int) float64 {
+	hits := 0
+	for i := 0; i < requests; i++ {
+		if lookup(c, next()) {
+			hits++
+		}
+	}
+
+	return float64(hits) / float64(requests)
+}
+
+func TestAdmissionBeatsLRUUnderScans(t *testing.T) {
+	lru := hitRatio(admissionCache(t, 1000, false), scanHeavyZipf(1), 50000)
+	admitted := hitRatio(admissionCache(t, 1000, true), scanHeavyZipf(1), 50000)
+
+	if admitted <= lru {
+		t.Fatal(fmt.Sprintf("hit ratio with admission %.3f, without %.3f", admitted, lru))
+	}
+}
+
+func BenchmarkZipfHitRatio(b *testing.B) {
+	for _, c := range []struct {
+		name      string
+		admission bool
+	}{
+		{"lru", false},
+		{"admission", true},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			cache := admissionCache(b, 1000, c.admission)
+			next := scanHeavyZipf(1)
+
+			b.ResetTimer()
+			b.ReportMetric(hitRatio(cache, next, b.N), "hit-ratio")
+		})
+	}
+}
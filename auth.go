@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var errMissingToken = errors.New("no bearer token")
+
+// decides whether a request may go any further, returning
+// the claims made about whoever sent it. set Auth in the
+// options to plug in something of your own, -jwt-key sets
+// it to check JSON web tokens
+type AuthFunc func(r *http.Request) (map[string]interface{}, error)
+
+type internalRequestKey struct{}
+
+// requests the proxy makes of itself, for priming and
+// warmup, have nobody to authenticate
+func internalRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, internalRequestKey{}, true)
+}
+
+func isInternalRequest(r *http.Request) bool {
+	internal, _ := r.Context().Value(internalRequestKey{}).(bool)
+	return internal
+}
+
+// -jwt-claim-headers sub=X-User,email=X-User-Email sends
+// claims on to the origin as headers
+type claimHeaders map[string]string
+
+func (ch claimHeaders) String() string {
+	var s []string
+	for claim, header := range ch {
+		s = append(s, claim+"="+header)
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (ch claimHeaders) Set(v string) error {
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+			return errors.New(fmt.Sprintf("invalid claim header %q, must be claim=Header", pair))
+		}
+
+		ch[parts[0]] = http.CanonicalHeaderKey(strings.TrimSpace(parts[1]))
+	}
+
+	return nil
+}
+
+// the headers claims are sent as, in a stable order as
+// they make up part of the cache key
+func (ch claimHeaders) headers() []string {
+	var headers []string
+	for _, header := range ch {
+		headers = append(headers, header)
+	}
+
+	sort.Strings(headers)
+	return headers
+}
+
+func claimValue(v interface{}) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case float64, bool:
+		return fmt.Sprint(c)
+	}
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// turns away with a 401 anything o.Auth doesn't accept
+func authenticate(o *options, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if isInternalRequest(r) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		// only we get to say who the client is
+		for _, header := range o.ClaimHeaders {
+			r.Header.Del(header)
+		}
+
+		claims, err := o.Auth(r)
+		if err != nil {
+			challenge := "Bearer"
+			if err != errMissingToken {
+				challenge = `Bearer error="invalid_token"`
+			}
+
+			rw.Header().Set("WWW-Authenticate", challenge)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		for claim, header := range o.ClaimHeaders {
+			if v, ok := claims[claim]; ok && v != nil {
+				r.Header.Set(header, claimValue(v))
+			}
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
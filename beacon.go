@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sonewman/rox"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the body of a beacon answered here is read and thrown
+// away so the conn can be reused, up to this much of it
+const maxBeaconBody = 64 << 10
+
+// repeatable -beacon /path or /prefix* for analytics
+// endpoints that answer everything with a 204. once the
+// origin has answered one, the rest get its 204 from here
+// for as long as it says it's fresh, whatever the query
+type beaconRoutes []string
+
+func (b *beaconRoutes) String() string {
+	return strings.Join(*b, ",")
+}
+
+func (b *beaconRoutes) Set(v string) error {
+	if !strings.HasPrefix(v, "/") {
+		return errors.New(fmt.Sprintf("invalid beacon route %q, must be /path or /prefix*", v))
+	}
+
+	*b = append(*b, v)
+	return nil
+}
+
+type beacons struct {
+	routes  beaconRoutes
+	ttl     int
+	lk      sync.Mutex
+	answers map[string]*CachedResponse
+}
+
+func (b *beacons) route(path string) (string, bool) {
+	for _, pattern := range b.routes {
+		if matchPath(pattern, path) {
+			return pattern, true
+		}
+	}
+
+	return "", false
+}
+
+func (b *beacons) answer(pattern string, now time.Time) *CachedResponse {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if cr := b.answers[pattern]; cr != nil && cr.Fresh(now) {
+		return cr
+	}
+
+	return nil
+}
+
+// what the origin sent with its 204, less anything that
+// belonged to the client who happened to ask first
+func (b *beacons) remember(pattern string, h http.Header) {
+	header := make(http.Header)
+	rox.CopyHeader(header, h)
+	for _, name := range []string{"Set-Cookie", "Date", "Server-Timing"} {
+		header.Del(name)
+	}
+
+	cc := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+	if _, ok := cc["no-store"]; ok {
+		return
+	}
+
+	cr := &CachedResponse{Header: header, StatusCode: http.StatusNoContent}
+	cr.expire(cc, b.ttl)
+
+	b.lk.Lock()
+	b.answers[pattern] = cr
+	b.lk.Unlock()
+}
+
+// notes the headers of a 204 as it is written
+type beaconWriter struct {
+	http.ResponseWriter
+	header http.Header
+	wrote  bool
+}
+
+func (bw *beaconWriter) WriteHeader(code int) {
+	if !bw.wrote {
+		bw.wrote = true
+		if code == http.StatusNoContent {
+			bw.header = bw.Header().Clone()
+		}
+	}
+
+	bw.ResponseWriter.WriteHeader(code)
+}
+
+func (bw *beaconWriter) Write(b []byte) (int, error) {
+	if !bw.wrote {
+		bw.WriteHeader(http.StatusOK)
+	}
+
+	return bw.ResponseWriter.Write(b)
+}
+
+func (bw *beaconWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
+
+func serveBeacons(o *options, next http.Handler) http.Handler {
+	b := &beacons{
+		routes:  *o.Beacons,
+		ttl:     *o.TTL,
+		answers: make(map[string]*CachedResponse),
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		pattern, ok := b.route(r.URL.Path)
+		if !ok {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if cr := b.answer(pattern, time.Now()); cr != nil {
+			io.Copy(io.Discard, io.LimitReader(r.Body, maxBeaconBody))
+			rox.CopyHeader(rw.Header(), cr.Header)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		bw := &beaconWriter{ResponseWriter: rw}
+		next.ServeHTTP(bw, r)
+
+		if bw.header != nil {
+			b.remember(pattern, bw.header)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func beaconOrigin(t *testing.T, cacheControl string, status int) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", cacheControl)
+		rw.Header().Set("Set-Cookie", "visitor=first")
+		rw.Header().Set("X-Collector", "v2")
+		rw.WriteHeader(status)
+	})
+}
+
+func TestBeaconsGetALocal204AfterTheFirst(t *testing.T) {
+	origin := beaconOrigin(t, "max-age=60", http.StatusNoContent)
+	base, _ := newProxy(t, origin.URL, "-beacon", "/collect*")
+
+	get(t, base+"/collect?event=first")
+
+	for _, u := range []string{"/collect?event=view", "/collect/v2?event=click"} {
+		res, _ := get(t, base+u)
+		if res.StatusCode != http.StatusNoContent || res.Header.Get("X-Collector") != "v2" {
+			t.Fatal(fmt.Sprintf("%s got %d, want the origin's 204", u, res.StatusCode))
+		}
+
+		if res.Header.Get("Set-Cookie") != "" {
+			t.Fatal(fmt.Sprintf("%s was sent the first client's cookie", u))
+		}
+	}
+
+	req, _ := http.NewRequest("POST", base+"/collect", strings.NewReader(`{"event":"scroll"}`))
+	res, err := testTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal(fmt.Sprintf("POST got %d, want 204", res.StatusCode))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d beacons, want 1", n))
+	}
+}
+
+func TestBeaconsAreForwardedUnlessA204CanBeKept(t *testing.T) {
+	for _, c := range []struct {
+		cacheControl string
+		status       int
+	}{
+		{"no-store", http.StatusNoContent},
+		{"max-age=60", http.StatusOK},
+	} {
+		origin := beaconOrigin(t, c.cacheControl, c.status)
+		base, _ := newProxy(t, origin.URL, "-beacon", "/collect")
+
+		get(t, base+"/collect")
+		get(t, base+"/collect")
+		get(t, base+"/other")
+
+		if n := origin.requests.Load(); n != 3 {
+			t.Fatal(fmt.Sprintf("%d %s: origin saw %d requests, want 3", c.status, c.cacheControl, n))
+		}
+	}
+}
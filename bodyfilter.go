@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// repeatable -no-cache-body regexp, bodies that match are
+// served but never cached, e.g. a page that slipped out
+// with "logged in as" on it
+type bodyFilters []*regexp.Regexp
+
+func (f *bodyFilters) String() string {
+	var s []string
+	for _, re := range *f {
+		s = append(s, re.String())
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (f *bodyFilters) Set(v string) error {
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid body filter %q: %s", v, err))
+	}
+
+	*f = append(*f, re)
+	return nil
+}
+
+// gzip bodies are matched as they are inflated rather
+// than inflated into another copy first
+func contentReader(cr *CachedResponse) (io.RuneReader, error) {
+	switch strings.ToLower(cr.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return bytes.NewReader(cr.Body), nil
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(cr.Body))
+		if err != nil {
+			return nil, err
+		}
+
+		return bufio.NewReader(zr), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("can't inspect %s encoded body", cr.Header.Get("Content-Encoding")))
+}
+
+// a body that can't be inspected can't be shown to be
+// safe either, so it isn't cached
+func (f bodyFilters) rejects(cr *CachedResponse) bool {
+	for _, re := range f {
+		r, err := contentReader(cr)
+		if err != nil {
+			return true
+		}
+
+		if re.MatchReader(r) {
+			return true
+		}
+	}
+
+	return false
+}
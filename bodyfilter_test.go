@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func personalizedOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+
+		body := "<p>welcome</p>"
+		if r.URL.Path == "/account" {
+			body = "<p>logged in as alice</p>"
+		}
+
+		switch r.URL.Query().Get("encoding") {
+		case "gzip":
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			io.WriteString(zw, body)
+			zw.Close()
+
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.Write(buf.Bytes())
+		case "br":
+			rw.Header().Set("Content-Encoding", "br")
+			io.WriteString(rw, "not really brotli")
+		default:
+			io.WriteString(rw, body)
+		}
+	})
+}
+
+func TestMatchingBodyIsServedButNotCached(t *testing.T) {
+	origin := personalizedOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-no-cache-body", "logged in as")
+
+	for _, path := range []string{"/account", "/account?encoding=gzip"} {
+		before := origin.requests.Load()
+
+		res, body := get(t, base+path)
+		if res.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Fatal(fmt.Sprintf("%s got %d %q, want it served", path, res.StatusCode, body))
+		}
+
+		get(t, base+path)
+		if n := origin.requests.Load() - before; n != 2 {
+			t.Fatal(fmt.Sprintf("%s reached the origin %d times, want it not cached", path, n))
+		}
+	}
+
+	if _, body := get(t, base+"/account"); body != "<p>logged in as alice</p>" {
+		t.Fatal(fmt.Sprintf("got %q", body))
+	}
+}
+
+func TestNonMatchingBodyIsCached(t *testing.T) {
+	origin := personalizedOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-no-cache-body", "logged in as")
+
+	get(t, base+"/home?encoding=gzip")
+	get(t, base+"/home?encoding=gzip")
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+func TestUninspectableBodyIsNotCached(t *testing.T) {
+	origin := personalizedOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-no-cache-body", "logged in as")
+
+	get(t, base+"/home?encoding=br")
+	get(t, base+"/home?encoding=br")
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// -request-budget bounds how long a client waits on the
+// origin to start answering. once it's spent the origin
+// request is given up on and whatever is cached is served,
+// however stale, or a 504 if there's nothing. a body that
+// has started arriving is left to finish
+type requestBudget struct {
+	timer *time.Timer
+	spent atomic.Bool
+}
+
+// cancel is called if the budget runs out, counted from
+// when the request was first looked up
+func startBudget(o *options, start time.Time, cancel func()) *requestBudget {
+	if *o.RequestBudget <= 0 {
+		return nil
+	}
+
+	b := &requestBudget{}
+	b.timer = time.AfterFunc(*o.RequestBudget-time.Since(start), func() {
+		b.spent.Store(true)
+		cancel()
+	})
+
+	return b
+}
+
+// the origin has answered, it can take as long as it
+// needs over the body
+func (b *requestBudget) stop() {
+	if b != nil {
+		b.timer.Stop()
+	}
+}
+
+func (b *requestBudget) exceeded() bool {
+	return b != nil && b.spent.Load()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// answers at once until slow is set, then holds every
+// request until it's given up on
+func slowOrigin(t *testing.T, slow *atomic.Bool) *testOrigin {
+	var version atomic.Int64
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(rw, "v%d", version.Add(1))
+	})
+}
+
+func TestBudgetServesStaleFromASlowOrigin(t *testing.T) {
+	var slow atomic.Bool
+	origin := slowOrigin(t, &slow)
+	base, cache := newProxy(t, origin.URL, "-c", "-request-budget", "200ms")
+
+	get(t, base+"/a")
+	// well past anything -stale-if-error would allow
+	age(t, cache, "/a", time.Hour)
+	slow.Store(true)
+
+	start := time.Now()
+	res, body := get(t, base+"/a")
+	took := time.Since(start)
+
+	if res.StatusCode != http.StatusOK || body != "v1" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the stale v1", res.StatusCode, body))
+	}
+
+	if took > 2*time.Second {
+		t.Fatal(fmt.Sprintf("took %s to answer, the budget was 200ms", took))
+	}
+
+	// put back for whoever asks next
+	if c := cachedEntry(t, cache, "/a"); c == nil {
+		t.Fatal("the stale entry was dropped")
+	}
+}
+
+func TestBudgetTimesOutWithNothingCached(t *testing.T) {
+	var slow atomic.Bool
+	slow.Store(true)
+	origin := slowOrigin(t, &slow)
+	base, _ := newProxy(t, origin.URL, "-c", "-request-budget", "200ms")
+
+	start := time.Now()
+	res, _ := get(t, base+"/a")
+	took := time.Since(start)
+
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal(fmt.Sprintf("got %d, want 504", res.StatusCode))
+	}
+
+	if took > 2*time.Second {
+		t.Fatal(fmt.Sprintf("took %s to answer, the budget was 200ms", took))
+	}
+}
+
+func TestBudgetLetsAStartedBodyFinish(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "first ")
+		rw.(http.Flusher).Flush()
+
+		time.Sleep(400 * time.Millisecond)
+		io.WriteString(rw, "second")
+	})
+	base, _ := newProxy(t, origin.URL, "-c", "-request-budget", "200ms")
+
+	res, body := get(t, base+"/a")
+	if res.StatusCode != http.StatusOK || body != "first second" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the whole body", res.StatusCode, body))
+	}
+}
+
+func TestBudgetIsOffByDefault(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(rw, "slow")
+	})
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	if res, body := get(t, base+"/a"); res.StatusCode != http.StatusOK || body != "slow" {
+		t.Fatal(fmt.Sprintf("got %d %q, want to wait for the origin", res.StatusCode, body))
+	}
+}
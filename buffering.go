@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sonewman/rox"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var errBufferTimeout = errors.New("origin took too long to send the whole body")
+
+// a body that stops the buffering for the cache once the
+// deadline has passed, every read after that one goes
+// through as normal so the rest can be streamed instead.
+// reads before the deadline are made in the background so
+// an origin that stalls mid-read can't hold us past it,
+// what that read brings back is handed on afterwards
+type bufferDeadline struct {
+	io.ReadCloser
+	deadline time.Time
+	expired  bool
+
+	reading chan bufferedRead
+	buf     []byte
+	left    []byte
+	err     error
+}
+
+type bufferedRead struct {
+	n   int
+	err error
+}
+
+func withBufferTimeout(o *options, res *http.Response, start time.Time) {
+	if *o.BufferTimeout > 0 {
+		res.Body = &bufferDeadline{ReadCloser: res.Body, deadline: start.Add(*o.BufferTimeout)}
+	}
+}
+
+func (bd *bufferDeadline) Read(p []byte) (int, error) {
+	if len(bd.left) > 0 || bd.err != nil {
+		return bd.handOn(p)
+	}
+
+	if bd.expired && bd.reading == nil {
+		return bd.ReadCloser.Read(p)
+	}
+
+	if !bd.expired && time.Now().After(bd.deadline) {
+		bd.expired = true
+		return 0, errBufferTimeout
+	}
+
+	if bd.reading == nil {
+		if cap(bd.buf) < len(p) {
+			bd.buf = make([]byte, len(p))
+		}
+
+		// buffered so the read can finish whether or not
+		// anyone is still waiting on it
+		bd.reading = make(chan bufferedRead, 1)
+		go func(buf []byte, reading chan<- bufferedRead) {
+			n, err := bd.ReadCloser.Read(buf)
+			reading <- bufferedRead{n, err}
+		}(bd.buf[:len(p)], bd.reading)
+	}
+
+	var r bufferedRead
+	if bd.expired {
+		r = <-bd.reading
+	} else {
+		timer := time.NewTimer(time.Until(bd.deadline))
+		defer timer.Stop()
+
+		select {
+		case r = <-bd.reading:
+		case <-timer.C:
+			bd.expired = true
+			return 0, errBufferTimeout
+		}
+	}
+
+	bd.reading = nil
+	bd.left, bd.err = bd.buf[:r.n], r.err
+	return bd.handOn(p)
+}
+
+// passes on what the last background read brought back,
+// its error only once all of that has gone
+func (bd *bufferDeadline) handOn(p []byte) (int, error) {
+	n := copy(p, bd.left)
+	bd.left = bd.left[n:]
+	if len(bd.left) > 0 {
+		return n, nil
+	}
+
+	err := bd.err
+	bd.err = nil
+	return n, err
+}
+
+func bufferExpired(res *http.Response) bool {
+	bd, ok := res.Body.(*bufferDeadline)
+	return ok && bd.expired
+}
+
+// sends what was buffered before the deadline as it came
+// from the origin, followed by the rest as it arrives
+func streamPartial(rw http.ResponseWriter, out *http.Request, cr *CachedResponse, res *http.Response) {
+	log.Println(fmt.Sprintf("%s took longer than -buffer-timeout, streaming rather than caching", out.URL))
+
+	rox.CopyHeader(rw.Header(), cr.Header)
+	rw.WriteHeader(cr.StatusCode)
+	if _, err := rw.Write(cr.Body); err != nil {
+		return
+	}
+
+	// the origin may still be stalled, the client needn't
+	// wait on it for what we already have
+	http.NewResponseController(rw).Flush()
+	io.Copy(rw, res.Body)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sends its body a part at a time, pause apart
+func tricklingOrigin(t *testing.T, pause time.Duration) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		for i := 1; i <= 3; i++ {
+			if i > 1 {
+				time.Sleep(pause)
+			}
+			fmt.Fprintf(rw, "part%d", i)
+			rw.(http.Flusher).Flush()
+		}
+	})
+}
+
+func TestSlowOriginIsPassedThroughUncached(t *testing.T) {
+	origin := tricklingOrigin(t, 100*time.Millisecond)
+	base, cache := newProxy(t, origin.URL, "-c", "-buffer-timeout", "50ms")
+
+	for i := 0; i < 2; i++ {
+		res, body := get(t, base+"/slow")
+		if res.StatusCode != http.StatusOK || body != "part1part2part3" {
+			t.Fatal(fmt.Sprintf("got %d %q, want the whole body streamed", res.StatusCode, body))
+		}
+	}
+
+	if cachedEntry(t, cache, "/slow") != nil {
+		t.Fatal("a body slower than -buffer-timeout was cached")
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestStalledOriginIsStreamedAtTheDeadline(t *testing.T) {
+	release := make(chan struct{})
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "part1")
+		rw.(http.Flusher).Flush()
+		<-release
+		io.WriteString(rw, "part2")
+	})
+	defer close(release)
+	base, _ := newProxy(t, origin.URL, "-c", "-buffer-timeout", "50ms")
+
+	// nothing more comes until we say so, the client
+	// should be getting what there is well before then
+	start := time.Now()
+	req, _ := http.NewRequest("GET", base+"/stalled", nil)
+	res, err := testTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	part := make([]byte, 5)
+	if _, err := io.ReadFull(res.Body, part); err != nil || string(part) != "part1" {
+		t.Fatal(fmt.Sprintf("read %q, %v", part, err))
+	}
+
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatal(fmt.Sprintf("took %s to start streaming", waited))
+	}
+}
+
+func TestOriginWithinBufferTimeoutIsCached(t *testing.T) {
+	origin := tricklingOrigin(t, time.Millisecond)
+	base, _ := newProxy(t, origin.URL, "-c", "-buffer-timeout", "5s")
+
+	get(t, base+"/fast")
+	if _, body := get(t, base+"/fast"); body != "part1part2part3" {
+		t.Fatal(fmt.Sprintf("got %q", body))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+func TestBufferDeadlineOnlyInterruptsOnce(t *testing.T) {
+	bd := &bufferDeadline{ReadCloser: io.NopCloser(strings.NewReader("rest")), deadline: time.Now().Add(-time.Second)}
+
+	if _, err := bd.Read(make([]byte, 8)); err != errBufferTimeout {
+		t.Fatal(fmt.Sprintf("first read past the deadline got %v", err))
+	}
+
+	if rest, err := io.ReadAll(bd); err != nil || string(rest) != "rest" {
+		t.Fatal(fmt.Sprintf("the rest read as %q, %v", rest, err))
+	}
+}
+
+func TestBufferDeadlineDoesntWaitOnAStalledRead(t *testing.T) {
+	pr, pw := io.Pipe()
+	bd := &bufferDeadline{ReadCloser: pr, deadline: time.Now().Add(50 * time.Millisecond)}
+
+	if _, err := bd.Read(make([]byte, 8)); err != errBufferTimeout {
+		t.Fatal(fmt.Sprintf("a read stalled past the deadline got %v", err))
+	}
+
+	// what the abandoned read gets isn't lost
+	go func() {
+		io.WriteString(pw, "late")
+		pw.Close()
+	}()
+
+	if rest, err := io.ReadAll(bd); err != nil || string(rest) != "late" {
+		t.Fatal(fmt.Sprintf("the rest read as %q, %v", rest, err))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directive names are lowercased and quoted values
+// unquoted, directives without a value map to ""
+func parseCacheControl(h string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, part := range strings.Split(h, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+
+		var value string
+		if len(kv) == 2 {
+			value = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+
+		directives[name] = value
+	}
+
+	return directives
+}
+
+func responseCacheControl(res *http.Response) map[string]string {
+	return parseCacheControl(strings.Join(res.Header.Values("Cache-Control"), ","))
+}
+
+// a shared cache must not keep anything the origin has
+// said is private or not to be stored
+func isCacheable(res *http.Response) bool {
+	cc := responseCacheControl(res)
+
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+
+	return true
+}
+
+// RFC 9111 has delta-seconds too large to represent taken
+// as 2^31, which also keeps them clear of overflowing a
+// time.Duration
+const maxDeltaSeconds = 1 << 31
+
+// delta-seconds directives such as max-age=60
+func directiveSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && n > 0 {
+		n, err = maxDeltaSeconds, nil
+	}
+
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	if n > maxDeltaSeconds {
+		n = maxDeltaSeconds
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// a client sending min-fresh=N wants nothing that will go
+// stale within N seconds, and so nothing already stale
+// either, stale-while-revalidate or not
+func minFresh(req *http.Request) time.Duration {
+	cc := parseCacheControl(strings.Join(req.Header.Values("Cache-Control"), ","))
+	d, _ := directiveSeconds(cc, "min-fresh")
+	return d
+}
+
+// a client asking for what it gets to be checked with the
+// origin first. HTTP/1.0 clients only know Pragma, which
+// is ignored when there's a Cache-Control to go by
+func requestNoCache(req *http.Request) bool {
+	if values := req.Header.Values("Cache-Control"); len(values) > 0 {
+		_, ok := parseCacheControl(strings.Join(values, ","))["no-cache"]
+		return ok
+	}
+
+	for _, v := range req.Header.Values("Pragma") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func FuzzParseCacheControl(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		",,,",
+		"=",
+		"max-age=60",
+		"MAX-AGE = 60",
+		`s-maxage="600", max-age=60`,
+		`no-cache="Set-Cookie, Authorization"`,
+		`private, no-store`,
+		"max-age=-1",
+		"max-age=99999999999999999999999",
+		"stale-while-revalidate=30, stale-if-error",
+		`"`,
+		`max-age="`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, h string) {
+		cc := parseCacheControl(h)
+
+		for name, value := range cc {
+			if name != strings.ToLower(name) || name != strings.TrimSpace(name) {
+				t.Fatal(fmt.Sprintf("directive %q isn't lowercased and trimmed", name))
+			}
+
+			if strings.HasPrefix(value, `"`) || strings.HasSuffix(value, `"`) {
+				t.Fatal(fmt.Sprintf("value %q of %s is still quoted", value, name))
+			}
+
+			if d, ok := directiveSeconds(cc, name); ok && d < 0 {
+				t.Fatal(fmt.Sprintf("%s=%s is %s", name, value, d))
+			}
+		}
+
+		isCacheable(&http.Response{Header: http.Header{"Cache-Control": {h}}})
+	})
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(`Max-Age=60, s-maxage="600", no-cache="Set-Cookie", private`)
+
+	for name, want := range map[string]string{
+		"max-age":  "60",
+		"s-maxage": "600",
+		"no-cache": "Set-Cookie",
+		"private":  "",
+	} {
+		if got, ok := cc[name]; !ok || got != want {
+			t.Fatal(fmt.Sprintf("%s is %q, want %q", name, got, want))
+		}
+	}
+}
+
+func TestHugeDeltaSecondsAreCapped(t *testing.T) {
+	for _, v := range []string{"9227000000", "99999999999999999999999"} {
+		d, ok := directiveSeconds(map[string]string{"max-age": v}, "max-age")
+		if !ok || d != maxDeltaSeconds*time.Second {
+			t.Fatal(fmt.Sprintf("max-age=%s is %s, want 2^31 seconds", v, d))
+		}
+	}
+}
+
+func TestSMaxAgeIsTheProxyTTL(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "s-maxage=600, max-age=60")
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-ttl", "5")
+
+	res, _ := get(t, base+"/a")
+	if cc := res.Header.Get("Cache-Control"); cc != "s-maxage=600, max-age=60" {
+		t.Fatal(fmt.Sprintf("client got Cache-Control %q, want the origin's", cc))
+	}
+
+	cr := cachedEntry(t, cache, "/a")
+	if cr == nil {
+		t.Fatal("nothing cached for /a")
+	}
+
+	if ttl := cr.Expires.Sub(cr.Stored); ttl != 600*time.Second {
+		t.Fatal(fmt.Sprintf("proxy TTL %s, want s-maxage's 10m0s", ttl))
+	}
+
+	// a client cache would have let it go by now, we don't
+	age(t, cache, "/a", 120*time.Second)
+	get(t, base+"/a")
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+func versionOrigin(t *testing.T, version *atomic.Int64) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(rw, "v%d", version.Add(1))
+	})
+}
+
+func TestMinFreshRefetchesNearExpiry(t *testing.T) {
+	var version atomic.Int64
+	origin := versionOrigin(t, &version)
+	base, cache := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/a")
+
+	// 60s left
+	if _, body := get(t, base+"/a", "Cache-Control", "min-fresh=30"); body != "v1" {
+		t.Fatal(fmt.Sprintf("comfortably fresh entry was refetched, got %s", body))
+	}
+
+	// 20s left
+	age(t, cache, "/a", 40*time.Second)
+
+	if _, body := get(t, base+"/a"); body != "v1" {
+		t.Fatal(fmt.Sprintf("got %s without min-fresh, want the cached v1", body))
+	}
+
+	if _, body := get(t, base+"/a", "Cache-Control", "min-fresh=30"); body != "v2" {
+		t.Fatal(fmt.Sprintf("got %s, want an entry near expiry refetched", body))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestMinFreshIsNeverServedStale(t *testing.T) {
+	var version atomic.Int64
+	origin := versionOrigin(t, &version)
+	base, cache := newProxy(t, origin.URL, "-c", "-stale-while-revalidate", "60s")
+
+	get(t, base+"/a")
+	age(t, cache, "/a", 70*time.Second)
+
+	if _, body := get(t, base+"/a", "Cache-Control", "min-fresh=1"); body != "v2" {
+		t.Fatal(fmt.Sprintf("got %s, want a stale entry refetched in the foreground", body))
+	}
+}
+
+// answers revalidations of what it sent with a 304,
+// counting them in revalidations
+func etagOrigin(t *testing.T, revalidations *atomic.Int64) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations.Add(1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		io.WriteString(rw, "v1")
+	})
+}
+
+func TestPragmaNoCacheRevalidates(t *testing.T) {
+	var revalidations atomic.Int64
+	origin := etagOrigin(t, &revalidations)
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/a")
+
+	res, body := get(t, base+"/a", "Pragma", "no-cache")
+	if res.StatusCode != http.StatusOK || body != "v1" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the revalidated v1", res.StatusCode, body))
+	}
+
+	if n := revalidations.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin revalidated %d times, want once", n))
+	}
+
+	// everyone else still gets the cached copy
+	get(t, base+"/a")
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestPragmaIsIgnoredWithCacheControl(t *testing.T) {
+	var revalidations atomic.Int64
+	origin := etagOrigin(t, &revalidations)
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/a")
+	get(t, base+"/a", "Pragma", "no-cache", "Cache-Control", "max-age=600")
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, Pragma should give way to Cache-Control", n))
+	}
+}
+
+func TestRequestNoCacheCanBeTurnedOff(t *testing.T) {
+	var revalidations atomic.Int64
+	origin := etagOrigin(t, &revalidations)
+	base, _ := newProxy(t, origin.URL, "-c", "-request-no-cache=false")
+
+	get(t, base+"/a")
+	get(t, base+"/a", "Pragma", "no-cache")
+	get(t, base+"/a", "Cache-Control", "no-cache")
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the cached copy served", n))
+	}
+}
+
+func TestRequestNoCache(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"Pragma", "no-cache"}, true},
+		{[]string{"Pragma", "NO-CACHE"}, true},
+		{[]string{"Pragma", "foo, no-cache"}, true},
+		{[]string{"Pragma", "foo"}, false},
+		{[]string{"Cache-Control", "no-cache"}, true},
+		{[]string{"Cache-Control", "max-age=0, no-cache"}, true},
+		{[]string{"Cache-Control", "max-age=0", "Pragma", "no-cache"}, false},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		for i := 0; i < len(test.header); i += 2 {
+			req.Header.Add(test.header[i], test.header[i+1])
+		}
+
+		if got := requestNoCache(req); got != test.want {
+			t.Fatal(fmt.Sprintf("%q: got %v, want %v", test.header, got, test.want))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// -client-cache-control /static=max-age=60 replaces the
+// Cache-Control sent to clients under a path prefix, so
+// browsers can be told to keep something for a minute
+// while the proxy keeps it for as long as s-maxage says
+type clientCacheControls map[string]string
+
+func (cc clientCacheControls) String() string {
+	var s []string
+	for prefix, value := range cc {
+		s = append(s, prefix+"="+value)
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
+// the value may hold commas of its own so each route is
+// given with its own -client-cache-control
+func (cc clientCacheControls) Set(v string) error {
+	parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || strings.TrimSpace(parts[1]) == "" {
+		return errors.New(fmt.Sprintf("invalid client cache control %q, must be /prefix=directives", v))
+	}
+
+	cc[parts[0]] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// the longest matching prefix decides
+func (cc clientCacheControls) lookup(path string) (string, bool) {
+	var match, value string
+
+	for prefix, v := range cc {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(match) {
+			match, value = prefix, v
+		}
+	}
+
+	return value, match != ""
+}
+
+// swaps Cache-Control just before the status line is
+// written, after the proxy has cached by what the origin
+// said. responses the origin marked private or no-store
+// keep their header, a browser shouldn't be told to hold
+// on to something nobody was meant to keep
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value string
+	wrote bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(code int) {
+	if !cw.wrote {
+		cw.wrote = true
+
+		h := cw.Header()
+		cc := parseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+		_, private := cc["private"]
+		_, noStore := cc["no-store"]
+
+		if !private && !noStore && code < 500 {
+			h.Set("Cache-Control", cw.value)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheControlWriter) Write(b []byte) (int, error) {
+	if !cw.wrote {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func rewriteClientCacheControl(routes clientCacheControls, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if value, ok := routes.lookup(r.URL.Path); ok {
+			rw = &cacheControlWriter{ResponseWriter: rw, value: value}
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
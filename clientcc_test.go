@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientCacheControlIsSeparateFromTheProxyTTL(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/static/private.js" {
+			rw.Header().Set("Cache-Control", "private, max-age=60")
+		} else {
+			rw.Header().Set("Cache-Control", "public, s-maxage=3600, max-age=3600")
+		}
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-client-cache-control", "/static=public, max-age=60")
+
+	// the miss and the hit after it
+	for i := 0; i < 2; i++ {
+		res, _ := get(t, base+"/static/app.js")
+		if got := res.Header.Get("Cache-Control"); got != "public, max-age=60" {
+			t.Fatal(fmt.Sprintf("client was sent Cache-Control %q", got))
+		}
+	}
+
+	// the proxy keeps it for the hour it was given
+	cr := cachedEntry(t, cache, "/static/app.js")
+	if cr == nil {
+		t.Fatal("nothing cached for /static/app.js")
+	}
+
+	if ttl := cr.Expires.Sub(cr.Stored); ttl != time.Hour || cr.Header.Get("Cache-Control") != "public, s-maxage=3600, max-age=3600" {
+		t.Fatal(fmt.Sprintf("proxy keeps it for %s with Cache-Control %q", ttl, cr.Header.Get("Cache-Control")))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+
+	for path, want := range map[string]string{
+		"/other":             "public, s-maxage=3600, max-age=3600",
+		"/static/private.js": "private, max-age=60",
+	} {
+		res, _ := get(t, base+path)
+		if got := res.Header.Get("Cache-Control"); got != want {
+			t.Fatal(fmt.Sprintf("%s was sent Cache-Control %q, want %q", path, got, want))
+		}
+	}
+}
+
+func TestClientCacheControlRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "static=max-age=60", "/static", "/static= "} {
+		if err := make(clientCacheControls).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		// an explicit q=0 means "not acceptable"
+		if len(fields) > 1 {
+			q := strings.TrimSpace(fields[1])
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && v == 0 {
+				continue
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// only worth holding a second copy of the body for
+// content types we've been told are hot and small
+// enough that the extra memory is acceptable
+func shouldPrecompress(o *options, cr *CachedResponse) bool {
+	if *o.Precompress == "" || len(cr.Body) == 0 || len(cr.Body) < *o.CompressMinSize || len(cr.Body) > *o.PrecompressMaxSize {
+		return false
+	}
+
+	// already encoded by the origin
+	if cr.Header.Get("Content-Encoding") != "" || cr.Gzip != nil {
+		return false
+	}
+
+	if noTransform(cr.Header) {
+		return false
+	}
+
+	ct := strings.ToLower(cr.Header.Get("Content-Type"))
+	for _, prefix := range strings.Split(*o.Precompress, ",") {
+		prefix = strings.ToLower(strings.TrimSpace(prefix))
+		if prefix != "" && strings.HasPrefix(ct, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// when gzip was forced on the origin the body is kept
+// decoded, and the bytes it sent become the gzip variant
+func decodeUpstreamGzip(cr *CachedResponse) error {
+	if !strings.EqualFold(cr.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+
+	// a HEAD has no body to decode, only headers describing
+	// the gzip one, and its length isn't the decoded length
+	if len(cr.Body) == 0 {
+		cr.Header.Del("Content-Encoding")
+		cr.Header.Del("Content-Length")
+		addVary(cr.Header, "Accept-Encoding")
+		return nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(cr.Body))
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	cr.Gzip = cr.Body
+	cr.Body = body
+	cr.Header.Del("Content-Encoding")
+	cr.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	addVary(cr.Header, "Accept-Encoding")
+	return nil
+}
+
+// drops the identity body once there's a gzip copy to
+// serve in its place, most clients take gzip and those
+// that don't can have it decompressed
+func (cr *CachedResponse) restCompressed() {
+	cr.length = len(cr.Body)
+	cr.Body = nil
+	cr.atRest = true
+}
+
+func (cr *CachedResponse) bodyLength() int {
+	if cr.atRest {
+		return cr.length
+	}
+
+	return len(cr.Body)
+}
+
+// the body as the origin's identity coding, decompressed
+// if it's only held gzipped. nil if it can't be
+func (cr *CachedResponse) identity() []byte {
+	if !cr.atRest {
+		return cr.Body
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(cr.Gzip))
+	if err != nil {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, cr.length))
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+// a copy of cr with its body decompressed for a client
+// that can't take gzip, the checksum of the identity body
+// catches a bad decompression, as does a nil body
+func (cr *CachedResponse) inflated() *CachedResponse {
+	return &CachedResponse{
+		Header:     cr.Header,
+		StatusCode: cr.StatusCode,
+		Body:       cr.identity(),
+
+		hasChecksum: cr.hasChecksum,
+		checksum:    cr.checksum,
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func gunzip(t *testing.T, b string) string {
+	t.Helper()
+
+	zr, err := gzip.NewReader(strings.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(decoded)
+}
+
+func TestPrecompressStoresBothVariantsOnFirstMiss(t *testing.T) {
+	css := strings.Repeat("body { color: red; }\n", 200)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		if strings.HasSuffix(r.URL.Path, ".css") {
+			rw.Header().Set("Content-Type", "text/css")
+		} else {
+			rw.Header().Set("Content-Type", "image/png")
+		}
+		io.WriteString(rw, css)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-precompress", "text/css")
+
+	// a client that doesn't take gzip fills it
+	if _, body := get(t, base+"/site.css"); body != css {
+		t.Fatal("first response wasn't the origin's body")
+	}
+
+	cr := cachedEntry(t, cache, "/site.css")
+	if cr == nil {
+		t.Fatal("nothing cached for /site.css")
+	}
+
+	if !bytes.Equal(cr.Body, []byte(css)) {
+		t.Fatal("identity variant not held")
+	}
+
+	if cr.Gzip == nil {
+		t.Fatal("gzip variant not held after a single miss")
+	}
+
+	res, body := get(t, base+"/site.css", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal(fmt.Sprintf("Content-Encoding %q, want gzip", res.Header.Get("Content-Encoding")))
+	}
+
+	if gunzip(t, body) != css {
+		t.Fatal("gzip variant didn't decode to the origin's body")
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+
+	// not a configured type
+	get(t, base+"/logo.png")
+	if cr := cachedEntry(t, cache, "/logo.png"); cr == nil || cr.Gzip != nil {
+		t.Fatal("unconfigured content type was precompressed")
+	}
+}
+
+// gzips only for clients that ask, as most origins do
+func negotiatingOrigin(t *testing.T, body string, seen *atomic.Value) *testOrigin {
+	gz, err := gzipBytes([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		seen.Store(r.Header.Get("Accept-Encoding"))
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			if r.Method != "HEAD" {
+				io.WriteString(rw, body)
+			}
+			return
+		}
+
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(gz)))
+		if r.Method != "HEAD" {
+			rw.Write(gz)
+		}
+	})
+}
+
+func TestUpstreamGzipIsForcedAndDecodedForClients(t *testing.T) {
+	body := strings.Repeat("plain text for everyone\n", 100)
+	var seen atomic.Value
+	origin := negotiatingOrigin(t, body, &seen)
+
+	base, _ := newProxy(t, origin.URL, "-c", "-upstream-gzip")
+
+	res, got := get(t, base+"/a")
+	if ae := seen.Load().(string); !strings.Contains(ae, "gzip") {
+		t.Fatal(fmt.Sprintf("origin was sent Accept-Encoding %q, want gzip", ae))
+	}
+
+	if got != body || res.Header.Get("Content-Encoding") != "" {
+		t.Fatal("a client that doesn't take gzip didn't get the identity body")
+	}
+
+	if res.ContentLength != int64(len(body)) {
+		t.Fatal(fmt.Sprintf("Content-Length %d, want %d", res.ContentLength, len(body)))
+	}
+
+	res, got = get(t, base+"/a", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" || gunzip(t, got) != body {
+		t.Fatal("a gzip client didn't get the origin's gzip body")
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want both served from one fill", n))
+	}
+}
+
+func TestUpstreamGzipLeavesHeadAlone(t *testing.T) {
+	body := strings.Repeat("plain text for everyone\n", 100)
+	var seen atomic.Value
+	origin := negotiatingOrigin(t, body, &seen)
+
+	base, _ := newProxy(t, origin.URL, "-c", "-upstream-gzip")
+
+	for i := 0; i < 2; i++ {
+		res, got := request(t, "HEAD", base+"/a")
+		if res.StatusCode != http.StatusOK {
+			t.Fatal(fmt.Sprintf("HEAD got %d, want 200", res.StatusCode))
+		}
+
+		if got != "" || res.Header.Get("Content-Encoding") != "" {
+			t.Fatal("HEAD claimed a gzip body it doesn't have")
+		}
+	}
+}
+
+func TestSmallBodiesAreNotCompressed(t *testing.T) {
+	small := strings.Repeat("s", 100)
+	large := strings.Repeat("l", 100<<10)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/small" {
+			io.WriteString(rw, small)
+		} else {
+			io.WriteString(rw, large)
+		}
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-precompress", "text/plain", "-compress-min-size", "1024")
+
+	for path, want := range map[string]string{"/small": small, "/large": large} {
+		// the fill, then the cached copy
+		for i := 0; i < 2; i++ {
+			res, body := get(t, base+path, "Accept-Encoding", "gzip")
+
+			gzipped := res.Header.Get("Content-Encoding") == "gzip"
+			if gzipped != (path == "/large") {
+				t.Fatal(fmt.Sprintf("%s served with Content-Encoding %q", path, res.Header.Get("Content-Encoding")))
+			}
+
+			if gzipped {
+				body = gunzip(t, body)
+			}
+
+			if body != want {
+				t.Fatal(fmt.Sprintf("%s body doesn't match the origin's", path))
+			}
+		}
+	}
+}
+
+func TestCompressAtRestServesTheStoredGzip(t *testing.T) {
+	css := strings.Repeat("body { color: red; }\n", 200)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/css")
+		io.WriteString(rw, css)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-precompress", "text/css", "-compress-at-rest")
+	get(t, base+"/site.css")
+
+	cr := cachedEntry(t, cache, "/site.css")
+	if cr == nil || cr.Body != nil || cr.Gzip == nil {
+		t.Fatal("only the gzip copy should be held")
+	}
+
+	res, body := get(t, base+"/site.css", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("Content-Length") != strconv.Itoa(len(cr.Gzip)) {
+		t.Fatal(fmt.Sprintf("Content-Encoding %q and Content-Length %q for %d gzipped bytes",
+			res.Header.Get("Content-Encoding"), res.Header.Get("Content-Length"), len(cr.Gzip)))
+	}
+
+	if body != string(cr.Gzip) || gunzip(t, body) != css {
+		t.Fatal("gzip client didn't get the stored bytes")
+	}
+
+	// anyone else gets it decompressed
+	res, body = get(t, base+"/site.css")
+	if body != css || res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Length") != strconv.Itoa(len(css)) {
+		t.Fatal(fmt.Sprintf("identity client got %d bytes with Content-Encoding %q and Content-Length %q",
+			len(body), res.Header.Get("Content-Encoding"), res.Header.Get("Content-Length")))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+func TestCompressAtRestNeverDecompressesForGzipClients(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/css")
+		io.WriteString(rw, strings.Repeat("a", 4096))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-precompress", "text/css", "-compress-at-rest")
+	get(t, base+"/site.css")
+
+	// anything that tried to decompress this would fail and
+	// go back to the origin
+	stored := "not gzip at all"
+	cachedEntry(t, cache, "/site.css").Gzip = []byte(stored)
+
+	for i := 0; i < 3; i++ {
+		res, body := get(t, base+"/site.css", "Accept-Encoding", "gzip")
+		if body != stored || res.Header.Get("Content-Length") != strconv.Itoa(len(stored)) {
+			t.Fatal(fmt.Sprintf("got %q with Content-Length %q, want the stored bytes as they are", body, res.Header.Get("Content-Length")))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, the stored copy was decompressed", n))
+	}
+}
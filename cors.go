@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// preflights for the same URL differ by who is asking and
+// what they're asking to do, so those are part of the key
+func preflightKey(r *http.Request) string {
+	var headers []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+				headers = append(headers, h)
+			}
+		}
+	}
+
+	sort.Strings(headers)
+
+	return strings.Join([]string{
+		r.Header.Get("Origin"),
+		r.Header.Get("Access-Control-Request-Method"),
+		strings.Join(headers, ","),
+	}, "|")
+}
+
+// a preflight is good for as long as the browser would
+// keep it itself
+func preflightTTL(cr *CachedResponse) {
+	secs, err := strconv.Atoi(cr.Header.Get("Access-Control-Max-Age"))
+	if err != nil || secs < 0 {
+		return
+	}
+
+	cr.Expires = cr.Stored.Add(time.Duration(secs) * time.Second)
+}
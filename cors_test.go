@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func preflightOrigin(t *testing.T, maxAge string) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		rw.Header().Set("Access-Control-Allow-Methods", r.Header.Get("Access-Control-Request-Method"))
+		rw.Header().Set("Access-Control-Max-Age", maxAge)
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func preflight(t *testing.T, u string, origin string, method string, headers string) *http.Response {
+	t.Helper()
+
+	res, _ := request(t, "OPTIONS", u,
+		"Origin", origin,
+		"Access-Control-Request-Method", method,
+		"Access-Control-Request-Headers", headers)
+
+	return res
+}
+
+func TestRepeatedPreflightIsAHit(t *testing.T) {
+	origin := preflightOrigin(t, "600")
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	preflight(t, base+"/api", "https://a.example", "PUT", "X-One, X-Two")
+	res := preflight(t, base+"/api", "https://a.example", "PUT", "x-two,x-one")
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d preflights, want 1", n))
+	}
+
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Fatal(fmt.Sprintf("cached preflight allowed %q", got))
+	}
+}
+
+func TestPreflightsDifferingInWhatTheyAskAreMisses(t *testing.T) {
+	origin := preflightOrigin(t, "600")
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	preflight(t, base+"/api", "https://a.example", "PUT", "X-One")
+	preflight(t, base+"/api", "https://b.example", "PUT", "X-One")
+	preflight(t, base+"/api", "https://a.example", "DELETE", "X-One")
+	res := preflight(t, base+"/api", "https://a.example", "PUT", "X-Other")
+
+	if n := origin.requests.Load(); n != 4 {
+		t.Fatal(fmt.Sprintf("origin saw %d preflights, want 4", n))
+	}
+
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "https://a.example" {
+		t.Fatal(fmt.Sprintf("preflight allowed %q", got))
+	}
+}
+
+func TestPreflightMaxAgeOfZeroIsNotKept(t *testing.T) {
+	origin := preflightOrigin(t, "0")
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	preflight(t, base+"/api", "https://a.example", "PUT", "X-One")
+	preflight(t, base+"/api", "https://a.example", "PUT", "X-One")
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d preflights, want 2", n))
+	}
+}
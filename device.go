@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// mobile is checked first, an Android user agent without
+// "mobi" in it is a tablet
+const defaultDeviceClasses = "mobile=mobi|iphone|ipod|blackberry|opera mini|windows phone,tablet=ipad|tablet|kindle|silk|playbook|android"
+
+type deviceRule struct {
+	class  string
+	tokens []string
+}
+
+// class=token|token,class=token|token, checked in order,
+// anything matching none of them is a desktop
+func parseDeviceClasses(s string) ([]deviceRule, error) {
+	var rules []deviceRule
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.SplitN(def, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf("invalid device class %q", def))
+		}
+
+		rule := deviceRule{class: parts[0]}
+		for _, token := range strings.Split(parts[1], "|") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				rule.tokens = append(rule.tokens, token)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func deviceClass(rules []deviceRule, r *http.Request) string {
+	ua := strings.ToLower(r.Header.Get("User-Agent"))
+
+	for _, rule := range rules {
+		for _, token := range rule.tokens {
+			if strings.Contains(ua, token) {
+				return rule.class
+			}
+		}
+	}
+
+	return "desktop"
+}
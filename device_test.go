@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	iphoneUA  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148"
+	androidUA = "Mozilla/5.0 (Linux; Android 14; Pixel 8) Mobile Safari/537.36"
+	desktopUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0 Safari/537.36"
+)
+
+func deviceOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		if strings.Contains(strings.ToLower(r.Header.Get("User-Agent")), "mobile") {
+			io.WriteString(rw, "mobile markup")
+		} else {
+			io.WriteString(rw, "desktop markup")
+		}
+	})
+}
+
+func TestDeviceClassesGetTheirOwnEntries(t *testing.T) {
+	origin := deviceOrigin(t)
+	base, cache := newProxy(t, origin.URL, "-c", "-vary-device")
+
+	if _, body := get(t, base+"/", "User-Agent", iphoneUA); body != "mobile markup" {
+		t.Fatal(fmt.Sprintf("mobile got %q", body))
+	}
+
+	res, body := get(t, base+"/", "User-Agent", desktopUA)
+	if body != "desktop markup" {
+		t.Fatal(fmt.Sprintf("desktop got %q", body))
+	}
+
+	if n := len(cachedEntries(t, cache, "GET", "/")); n != 2 {
+		t.Fatal(fmt.Sprintf("%d entries, want one per device class", n))
+	}
+
+	// caches further down have to split on it too
+	if v := strings.Join(res.Header.Values("Vary"), ","); !strings.Contains(v, "User-Agent") {
+		t.Fatal(fmt.Sprintf("Vary %q, want User-Agent", v))
+	}
+
+	// another phone is the same class
+	if _, body := get(t, base+"/", "User-Agent", androidUA); body != "mobile markup" {
+		t.Fatal(fmt.Sprintf("a second mobile UA got %q", body))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want one per device class", n))
+	}
+}
+
+func TestDeviceClassesDontFragmentKeyOnVary(t *testing.T) {
+	origin := deviceOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-vary-device", "-key-on-vary")
+
+	get(t, base+"/", "User-Agent", iphoneUA)
+	get(t, base+"/", "User-Agent", androidUA)
+	get(t, base+"/", "User-Agent", desktopUA)
+	get(t, base+"/", "User-Agent", desktopUA+" extra")
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the added Vary not to key on the raw User-Agent", n))
+	}
+}
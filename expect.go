@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// -expect-continue forward leaves Expect: 100-continue on
+// the request so the client is only told to go ahead once
+// the origin has agreed, and a refusal reaches it before
+// any of the body is sent. local takes it off and lets
+// the client send straight away
+func validExpectContinue(mode string) error {
+	if mode != "forward" && mode != "local" {
+		return errors.New(fmt.Sprintf("invalid -expect-continue %q, must be forward or local", mode))
+	}
+
+	return nil
+}
+
+// the server sends the client its 100 Continue as soon as
+// the body is first read, which is when the transport has
+// had one from the origin or given up waiting for it
+func expectContinue(o *options, out *http.Request) {
+	if *o.ExpectContinue == "local" && strings.EqualFold(out.Header.Get("Expect"), "100-continue") {
+		out.Header.Del("Expect")
+	}
+}
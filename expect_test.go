@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// takes uploads to /upload and turns away anything else
+// without reading it, noting the Expect header it was sent
+func uploadOrigin(t *testing.T, expect *atomic.Value) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		expect.Store(r.Header.Get("Expect"))
+		if r.URL.Path != "/upload" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(rw, "got "+string(body))
+	})
+}
+
+// sends the headers of a 100-continue upload and the body
+// only once told to. returns the interim status, 0 if
+// there wasn't one, and the final response
+func upload(t *testing.T, base string, path string) (int, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "POST "+path+" HTTP/1.1\r\nHost: proxy\r\nContent-Length: 5\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusContinue {
+		res.Body.Close()
+		return 0, res
+	}
+
+	io.WriteString(conn, "hello")
+	final, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, final
+}
+
+func TestExpectContinueIsForwarded(t *testing.T) {
+	var expect atomic.Value
+	origin := uploadOrigin(t, &expect)
+	base, _ := newProxy(t, origin.URL)
+
+	interim, res := upload(t, base, "/upload")
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if interim != http.StatusContinue || res.StatusCode != http.StatusOK || string(body) != "got hello" {
+		t.Fatal(fmt.Sprintf("got %d then %d %q", interim, res.StatusCode, body))
+	}
+
+	if got := expect.Load(); got != "100-continue" {
+		t.Fatal(fmt.Sprintf("origin was sent Expect %q", got))
+	}
+}
+
+func TestExpectContinueRefusalReachesTheClient(t *testing.T) {
+	var expect atomic.Value
+	origin := uploadOrigin(t, &expect)
+	base, _ := newProxy(t, origin.URL)
+
+	// the body is never sent, so without the refusal this
+	// would wait out the deadline
+	interim, res := upload(t, base, "/elsewhere")
+	if interim != 0 || res.StatusCode != http.StatusForbidden {
+		t.Fatal(fmt.Sprintf("got %d then %d, want the origin's 403 and no 100", interim, res.StatusCode))
+	}
+}
+
+func TestExpectContinueHandledLocally(t *testing.T) {
+	var expect atomic.Value
+	origin := uploadOrigin(t, &expect)
+	base, _ := newProxy(t, origin.URL, "-expect-continue", "local")
+
+	interim, res := upload(t, base, "/upload")
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if interim != http.StatusContinue || string(body) != "got hello" {
+		t.Fatal(fmt.Sprintf("got %d then %q", interim, body))
+	}
+
+	if got := expect.Load(); got != "" {
+		t.Fatal(fmt.Sprintf("origin was sent Expect %q", got))
+	}
+}
+
+func TestExpectContinueRejectsBadModes(t *testing.T) {
+	if err := validExpectContinue("ignore"); err == nil {
+		t.Fatal("ignore was accepted")
+	}
+}
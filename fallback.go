@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sonewman/rox"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// repeatable -fallback-origin /prefix=http://host, where
+// paths under prefix the origin 404s are tried again
+// against host, e.g. an old CDN during a migration
+type fallbackOrigins map[string]*url.URL
+
+func (f fallbackOrigins) String() string {
+	var s []string
+	for prefix, u := range f {
+		s = append(s, prefix+"="+u.String())
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (f fallbackOrigins) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return errors.New(fmt.Sprintf("invalid fallback origin %q", v))
+	}
+
+	u, err := url.Parse(parts[1])
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New(fmt.Sprintf("invalid fallback origin URL %q", parts[1]))
+	}
+
+	f[parts[0]] = u
+	return nil
+}
+
+// the longest prefix wins, as with cache pools
+func (f fallbackOrigins) origin(path string) *url.URL {
+	var match string
+	var origin *url.URL
+
+	for prefix, u := range f {
+		if strings.HasPrefix(path, prefix) && (origin == nil || len(prefix) > len(match)) {
+			match, origin = prefix, u
+		}
+	}
+
+	return origin
+}
+
+// a copy of out to be sent to origin rather than the target
+func toOrigin(o *options, out *http.Request, origin *url.URL) *http.Request {
+	alt := out.Clone(out.Context())
+	u := *out.URL
+	u.Scheme = origin.Scheme
+	u.Host = origin.Host
+	alt.URL = &u
+	alt.Host = origin.Host
+
+	// headers meant for the primary mustn't go elsewhere
+	for name := range o.OriginHeaders[strings.ToLower(out.URL.Host)] {
+		alt.Header.Del(name)
+	}
+	o.OriginHeaders.apply(alt)
+
+	return alt
+}
+
+// res is the origin's 404. the fallback's response takes
+// its place unless that fails too, in which case the 404
+// stands
+func tryFallback(o *options, p *rox.Rox, out *http.Request, res *http.Response) *http.Response {
+	fb := o.FallbackOrigins.origin(out.URL.Path)
+	if fb == nil {
+		return res
+	}
+
+	alt := toOrigin(o, out, fb)
+	fres, err := rox.DoRequest(p, alt)
+	maybeLog(o, alt)
+
+	if err != nil {
+		log.Println(fmt.Sprintf("fallback for %s failed: %s", out.URL, err))
+		return res
+	}
+
+	if fres.StatusCode >= 400 {
+		fres.Body.Close()
+		return res
+	}
+
+	res.Body.Close()
+	return fres
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestFallbackIsServedAndCachedWhenThePrimary404s(t *testing.T) {
+	primary := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	fallback := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "from the old cdn")
+	})
+
+	base, _ := newProxy(t, primary.URL, "-c", "-fallback-origin", "/assets="+fallback.URL)
+
+	for i := 0; i < 2; i++ {
+		res, body := get(t, base+"/assets/logo.png")
+		if res.StatusCode != http.StatusOK || body != "from the old cdn" {
+			t.Fatal(fmt.Sprintf("got %d %q, want the fallback's 200", res.StatusCode, body))
+		}
+	}
+
+	if p, f := primary.requests.Load(), fallback.requests.Load(); p != 1 || f != 1 {
+		t.Fatal(fmt.Sprintf("primary saw %d and fallback %d requests, want the second a hit", p, f))
+	}
+}
+
+func TestFallbackIsOnlyTriedUnderItsPrefix(t *testing.T) {
+	primary := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	fallback := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "from the old cdn")
+	})
+
+	base, _ := newProxy(t, primary.URL, "-c", "-fallback-origin", "/assets="+fallback.URL)
+
+	if res, _ := get(t, base+"/pages/about"); res.StatusCode != http.StatusNotFound {
+		t.Fatal(fmt.Sprintf("got %d, want the primary's 404", res.StatusCode))
+	}
+
+	if n := fallback.requests.Load(); n != 0 {
+		t.Fatal("fallback was tried outside its prefix")
+	}
+}
+
+func TestFallbackFailingLeavesThe404(t *testing.T) {
+	primary := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+		io.WriteString(rw, "primary 404")
+	})
+	fallback := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	})
+
+	base, _ := newProxy(t, primary.URL, "-c", "-fallback-origin", "/="+fallback.URL)
+
+	res, body := get(t, base+"/missing")
+	if res.StatusCode != http.StatusNotFound || body != "primary 404" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the primary's 404", res.StatusCode, body))
+	}
+}
+
+func TestFallbackOriginRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "/assets", "assets=http://cdn.example", "/assets=cdn.example", "/assets=http://"} {
+		if err := make(fallbackOrigins).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
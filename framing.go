@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// heads and lines longer than this are left for net/http
+// to turn away
+const (
+	maxFramingHead = 1<<20 + 4096
+	maxFramingLine = 4096
+)
+
+// stands in for a request whose framing could be read two
+// ways, no real client has any use for the method
+const ambiguousFramingMethod = "AMBIGUOUS-FRAMING"
+
+type framingState int
+
+const (
+	framingHead framingState = iota
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingChunkEnd
+	framingTrailer
+	framingPassthrough
+	framingRejected
+)
+
+// net/http settles a request with both Content-Length and
+// Transfer-Encoding by dropping the length before any
+// handler sees either, but whatever sits in front of us
+// may have settled it the other way and be out of step
+// with us about where the next request starts. so heads
+// are checked on the wire, and one that could be read two
+// ways is swapped for a marker request that gets a 400
+type framingListener struct {
+	net.Listener
+}
+
+func (l *framingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &framingConn{Conn: conn, rb: make([]byte, 4096)}, nil
+}
+
+// follows each request's framing as it is read so the
+// next head can be found. only heads are held back, and
+// only until they are complete
+type framingConn struct {
+	net.Conn
+	rb        []byte
+	state     framingState
+	buf       []byte
+	remaining int64
+	out       []byte
+}
+
+func (c *framingConn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		n, err := c.Conn.Read(c.rb)
+
+		// nothing past a rejected head is passed on, but the
+		// conn is left open rather than ended early, an EOF
+		// would cancel requests pipelined ahead of it
+		if c.state != framingRejected {
+			c.consume(c.rb[:n])
+		}
+
+		// deadlines are used to interrupt reads, so errors
+		// aren't kept, the conn reports them again if they last
+		if err != nil {
+			if len(c.out) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *framingConn) passthrough() {
+	c.out = append(c.out, c.buf...)
+	c.buf = nil
+	c.state = framingPassthrough
+}
+
+func (c *framingConn) consume(b []byte) {
+	for len(b) > 0 {
+		switch c.state {
+		case framingPassthrough:
+			c.out = append(c.out, b...)
+			return
+
+		case framingRejected:
+			return
+
+		case framingBody, framingChunkData:
+			n := int64(len(b))
+			if n > c.remaining {
+				n = c.remaining
+			}
+
+			c.out = append(c.out, b[:n]...)
+			b = b[n:]
+			c.remaining -= n
+
+			if c.remaining == 0 && c.state == framingBody {
+				c.state = framingHead
+			} else if c.remaining == 0 {
+				c.state = framingChunkEnd
+			}
+
+		case framingHead:
+			// blank lines between requests are net/http's to judge
+			for len(c.buf) == 0 && len(b) > 0 && (b[0] == '\r' || b[0] == '\n') {
+				c.out = append(c.out, b[0])
+				b = b[1:]
+			}
+
+			c.buf = append(c.buf, b...)
+			b = nil
+
+			end := headEnd(c.buf)
+			if end < 0 {
+				if len(c.buf) > maxFramingHead {
+					c.passthrough()
+				}
+				continue
+			}
+
+			head, rest := c.buf[:end], c.buf[end:]
+			c.buf = nil
+			c.request(head)
+			b = rest
+
+		default:
+			// chunk sizes, the CRLF after each chunk and
+			// trailers are lines, passed on as they come
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				c.buf = append(c.buf, b...)
+				c.out = append(c.out, b...)
+				b = nil
+
+				if len(c.buf) > maxFramingLine {
+					c.buf = nil
+					c.state = framingPassthrough
+				}
+				continue
+			}
+
+			line := append(c.buf, b[:i]...)
+			c.out = append(c.out, b[:i+1]...)
+			c.buf = nil
+			b = b[i+1:]
+			c.line(bytes.TrimRight(line, "\r"))
+		}
+	}
+}
+
+func headEnd(b []byte) int {
+	end := -1
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		end = i + 4
+	}
+
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 && (end < 0 || i+2 < end) {
+		end = i + 2
+	}
+
+	return end
+}
+
+func (c *framingConn) request(head []byte) {
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	requestLine := strings.Fields(lines[0])
+
+	var lengths, encodings []string
+	upgrade := false
+
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		switch strings.ToLower(name) {
+		case "content-length":
+			lengths = append(lengths, strings.TrimSpace(value))
+		case "transfer-encoding":
+			encodings = append(encodings, strings.TrimSpace(value))
+		case "upgrade":
+			upgrade = true
+		}
+	}
+
+	if reason := ambiguousFraming(requestLine, lengths, encodings); reason != "" {
+		c.out = append(c.out, ambiguousFramingMethod+" /"+reason+" HTTP/1.1\r\nHost: framing\r\nConnection: close\r\n\r\n"...)
+		c.state = framingRejected
+		return
+	}
+
+	c.out = append(c.out, head...)
+
+	switch {
+	case len(requestLine) > 0 && requestLine[0] == "CONNECT" || upgrade:
+		// no longer HTTP once the origin agrees
+		c.state = framingPassthrough
+
+	case len(encodings) > 0:
+		// anything but a lone chunked net/http refuses itself
+		c.state = framingPassthrough
+		if len(encodings) == 1 && strings.EqualFold(encodings[0], "chunked") {
+			c.state = framingChunkSize
+		}
+
+	case len(lengths) > 0:
+		n, err := strconv.ParseInt(lengths[0], 10, 64)
+		switch {
+		case err != nil || n < 0:
+			c.state = framingPassthrough
+		case n == 0:
+			c.state = framingHead
+		default:
+			c.state = framingBody
+			c.remaining = n
+		}
+
+	default:
+		c.state = framingHead
+	}
+}
+
+func ambiguousFraming(requestLine []string, lengths []string, encodings []string) string {
+	if len(lengths) > 0 && len(encodings) > 0 {
+		return "content-length-and-transfer-encoding"
+	}
+
+	for _, l := range lengths {
+		if l != lengths[0] {
+			return "conflicting-content-length"
+		}
+	}
+
+	// net/http ignores Transfer-Encoding from HTTP/1.0
+	// clients, where others might not
+	if len(encodings) > 0 && len(requestLine) == 3 && requestLine[2] == "HTTP/1.0" {
+		return "http-1.0-transfer-encoding"
+	}
+
+	return ""
+}
+
+func (c *framingConn) line(line []byte) {
+	switch c.state {
+	case framingChunkSize:
+		size, _, _ := strings.Cut(string(line), ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			c.state = framingPassthrough
+		case n == 0:
+			c.state = framingTrailer
+		default:
+			c.state = framingChunkData
+			c.remaining = n
+		}
+
+	case framingChunkEnd:
+		c.state = framingChunkSize
+		if len(line) != 0 {
+			c.state = framingPassthrough
+		}
+
+	case framingTrailer:
+		if len(line) == 0 {
+			c.state = framingHead
+		}
+	}
+}
+
+// answers the marker request framingConn put in place of
+// an ambiguous one
+func rejectAmbiguousFraming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != ambiguousFramingMethod {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		log.Println(fmt.Sprintf("rejected request from %s with ambiguous framing: %s", r.RemoteAddr, strings.TrimPrefix(r.URL.Path, "/")))
+		rw.Header().Set("Connection", "close")
+		rw.WriteHeader(http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoes what it was sent so a test can tell where the
+// proxy thought each request's body ended
+func echoOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(rw, "%s %s %s", r.Method, r.URL.Path, body)
+	})
+}
+
+// writes raw to the proxy in one go and reads back as many
+// responses as it is given, up to want
+func pipelined(t *testing.T, base string, raw string, want int) []*http.Response {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	var responses []*http.Response
+	for len(responses) < want {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			break
+		}
+
+		body, _ := io.ReadAll(res.Body)
+		res.Body = io.NopCloser(strings.NewReader(string(body)))
+		responses = append(responses, res)
+	}
+
+	return responses
+}
+
+func responseBody(res *http.Response) string {
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestAmbiguousFramingIsRejected(t *testing.T) {
+	origin := echoOrigin(t)
+	base, _ := newProxy(t, origin.URL)
+
+	for name, raw := range map[string]string{
+		"length and chunked": "POST /a HTTP/1.1\r\nHost: proxy\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"chunked and length": "POST /a HTTP/1.1\r\nHost: proxy\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n",
+		"length and other":   "POST /a HTTP/1.1\r\nHost: proxy\r\nContent-Length: 5\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+		"duplicate lengths":  "POST /a HTTP/1.1\r\nHost: proxy\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+		"chunked HTTP/1.0":   "POST /a HTTP/1.0\r\nHost: proxy\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+	} {
+		responses := pipelined(t, base, raw, 1)
+		if len(responses) != 1 || responses[0].StatusCode != http.StatusBadRequest {
+			t.Fatal(fmt.Sprintf("%s: got %v, want a 400", name, responses))
+		}
+
+		if !responses[0].Close {
+			t.Fatal(fmt.Sprintf("%s: connection left open after a 400", name))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal(fmt.Sprintf("origin saw %d ambiguous requests", n))
+	}
+}
+
+func TestAmbiguousFramingCheckCanBeTurnedOff(t *testing.T) {
+	origin := echoOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-reject-ambiguous-framing=false")
+
+	// left to net/http, which goes by Transfer-Encoding
+	raw := "POST /a HTTP/1.1\r\nHost: proxy\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	responses := pipelined(t, base, raw, 1)
+	if len(responses) != 1 {
+		t.Fatal(fmt.Sprintf("got %d responses", len(responses)))
+	}
+
+	if responses[0].StatusCode != http.StatusOK || origin.requests.Load() != 1 {
+		t.Fatal(fmt.Sprintf("got %d with %d origin requests, want it passed through", responses[0].StatusCode, origin.requests.Load()))
+	}
+}
+
+func TestMatchingDuplicateLengthsAreForwarded(t *testing.T) {
+	origin := echoOrigin(t)
+	base, _ := newProxy(t, origin.URL)
+
+	responses := pipelined(t, base, "POST /a HTTP/1.1\r\nHost: proxy\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", 1)
+	if len(responses) != 1 || responseBody(responses[0]) != "POST /a hello" {
+		t.Fatal(fmt.Sprintf("got %v", responses))
+	}
+}
+
+func TestChunkExtensionsAndTrailersKeepFraming(t *testing.T) {
+	origin := echoOrigin(t)
+	base, _ := newProxy(t, origin.URL)
+
+	// the chunk data looks like an ambiguous head and must
+	// be taken as data. what follows the trailers is the
+	// next request
+	chunk := "GET /x HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n"
+	raw := "POST /a HTTP/1.1\r\nHost: proxy\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		fmt.Sprintf("%x;name=value\r\n%s\r\n", len(chunk), chunk) +
+		"5;quoted=\"a;b\"\r\nhello\r\n" +
+		"0\r\nX-Trailer: yes\r\nX-Other: also\r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: proxy\r\n\r\n"
+
+	responses := pipelined(t, base, raw, 2)
+	if len(responses) != 2 {
+		t.Fatal(fmt.Sprintf("got %d responses, want 2", len(responses)))
+	}
+
+	if got := responseBody(responses[0]); got != "POST /a "+chunk+"hello" {
+		t.Fatal(fmt.Sprintf("chunked request got %q", got))
+	}
+
+	if got := responseBody(responses[1]); got != "GET /b " {
+		t.Fatal(fmt.Sprintf("request after the trailers got %q", got))
+	}
+}
+
+func TestPipelinedRequestsAreCheckedInTurn(t *testing.T) {
+	origin := echoOrigin(t)
+	base, _ := newProxy(t, origin.URL)
+
+	// a body that looks like an ambiguous head, then a
+	// request that is one
+	body := "GET /x HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n"
+	raw := fmt.Sprintf("POST /a HTTP/1.1\r\nHost: proxy\r\nContent-Length: %d\r\n\r\n%s", len(body), body) +
+		"GET /b HTTP/1.1\r\nHost: proxy\r\n\r\n" +
+		"POST /c HTTP/1.1\r\nHost: proxy\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" +
+		"GET /d HTTP/1.1\r\nHost: proxy\r\n\r\n"
+
+	responses := pipelined(t, base, raw, 4)
+	if len(responses) != 3 {
+		t.Fatal(fmt.Sprintf("got %d responses, want 3 and the connection closed", len(responses)))
+	}
+
+	if got := responseBody(responses[0]); got != "POST /a "+body {
+		t.Fatal(fmt.Sprintf("first request got %q", got))
+	}
+
+	if got := responseBody(responses[1]); got != "GET /b " {
+		t.Fatal(fmt.Sprintf("second request got %q", got))
+	}
+
+	if responses[2].StatusCode != http.StatusBadRequest {
+		t.Fatal(fmt.Sprintf("ambiguous request got %d, want 400", responses[2].StatusCode))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want nothing from the 400 on", n))
+	}
+}
+
+// what a framingConn passes on for in
+func framed(t *testing.T, in string) string {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go func() {
+		io.WriteString(client, in)
+		client.Close()
+	}()
+
+	out, err := io.ReadAll(&framingConn{Conn: server, rb: make([]byte, 16)})
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestUpgradedConnectionsArePassedThrough(t *testing.T) {
+	// once upgraded the conn isn't HTTP, whatever it
+	// happens to look like
+	after := "POST /a HTTP/1.1\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	for _, head := range []string{
+		"GET /socket HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+		"CONNECT origin.example:443 HTTP/1.1\r\nHost: origin.example:443\r\n\r\n",
+	} {
+		if got := framed(t, head+after); got != head+after {
+			t.Fatal(fmt.Sprintf("%q was passed on as %q", head+after, got))
+		}
+	}
+
+	// without the upgrade the second head is swapped out
+	plain := "GET /page HTTP/1.1\r\nHost: proxy\r\n\r\n"
+	if got := framed(t, plain+after); !strings.HasPrefix(got, plain+ambiguousFramingMethod) {
+		t.Fatal(fmt.Sprintf("ambiguous request was passed on as %q", got))
+	}
+}
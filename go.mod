@@ -0,0 +1,5 @@
+module github.com/sonewman/go-proxy
+
+go 1.22
+
+require go.uber.org/goleak v1.3.0
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"time"
+)
+
+// an entry pushed out while still in use is held here
+// for -eviction-grace, so asking for it again puts it
+// back rather than costing a trip to the origin
+type evicted struct {
+	key   string
+	cr    *CachedResponse
+	size  int
+	until time.Time
+}
+
+// every entry is held for the same grace, so the order
+// they were buried in is the order they expire in. what
+// is held is bounded by -eviction-grace-max-bytes, the
+// oldest going first, so evicting still frees memory
+type graveyard struct {
+	grace    time.Duration
+	maxBytes int
+
+	bytes   int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newGraveyard(grace time.Duration, maxBytes int) *graveyard {
+	return &graveyard{
+		grace:    grace,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (g *graveyard) remove(key string) {
+	if g == nil {
+		return
+	}
+
+	if el := g.entries[key]; el != nil {
+		g.order.Remove(el)
+		delete(g.entries, key)
+		g.bytes -= el.Value.(*evicted).size
+	}
+}
+
+func (g *graveyard) prune(now time.Time) {
+	for el := g.order.Front(); el != nil && now.After(el.Value.(*evicted).until); el = g.order.Front() {
+		g.remove(el.Value.(*evicted).key)
+	}
+}
+
+// must be called with the cache lock held
+func (c *Cache) bury(key string, used time.Time, now time.Time) {
+	g := c.graveyard
+	if g == nil {
+		return
+	}
+
+	g.prune(now)
+
+	cr := c.cache[key]
+	if cr == nil || cr.pending() || now.Sub(used) > g.grace {
+		return
+	}
+
+	size := cr.size()
+	if size > g.maxBytes {
+		return
+	}
+
+	g.remove(key)
+	g.entries[key] = g.order.PushBack(&evicted{key: key, cr: cr, size: size, until: now.Add(g.grace)})
+	g.bytes += size
+
+	for g.bytes > g.maxBytes {
+		g.remove(g.order.Front().Value.(*evicted).key)
+	}
+}
+
+// must be called with the cache lock held
+func (c *Cache) restore(req *http.Request, key string, now time.Time) *CachedResponse {
+	el := c.graveyard.entries[key]
+	if el == nil {
+		return nil
+	}
+
+	e := el.Value.(*evicted)
+	c.graveyard.remove(key)
+	if now.After(e.until) {
+		return nil
+	}
+
+	c.put(req, e.cr)
+	return c.cache[key]
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a cache with room for one entry, so /b evicts /a. how
+// many requests reached the origin for /a, /b then /a again
+func evictAndRequestAgain(t *testing.T, wait time.Duration, args ...string) int64 {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "0123456789")
+	})
+
+	base, _ := newProxy(t, origin.URL, append([]string{"-c", "-cache-pools", "/=1:0"}, args...)...)
+
+	get(t, base+"/a")
+	get(t, base+"/b")
+	time.Sleep(wait)
+
+	if _, body := get(t, base+"/a"); body != "0123456789" {
+		t.Fatal(fmt.Sprintf("/a was served %q", body))
+	}
+
+	return origin.requests.Load()
+}
+
+func TestEvictedEntryIsRestoredWithinGrace(t *testing.T) {
+	if n := evictAndRequestAgain(t, 0, "-eviction-grace", "5s"); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want /a restored", n))
+	}
+}
+
+func TestEvictedEntryIsRefetchedAfterGrace(t *testing.T) {
+	if n := evictAndRequestAgain(t, 100*time.Millisecond, "-eviction-grace", "50ms"); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want /a refetched", n))
+	}
+}
+
+func TestEvictedEntryOverGraceBytesIsRefetched(t *testing.T) {
+	if n := evictAndRequestAgain(t, 0, "-eviction-grace", "5s", "-eviction-grace-max-bytes", "5"); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want /a refetched", n))
+	}
+}
+
+func TestEvictedEntryIsRefetchedWithoutGrace(t *testing.T) {
+	if n := evictAndRequestAgain(t, 0); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want /a refetched", n))
+	}
+}
+
+func TestGraveyardDropsTheOldestOverMaxBytes(t *testing.T) {
+	c := &Cache{cache: make(map[string]*CachedResponse), graveyard: newGraveyard(time.Minute, 25)}
+	now := time.Now()
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.cache[key] = &CachedResponse{Body: []byte("0123456789")}
+		c.bury(key, now, now)
+	}
+
+	if c.graveyard.entries["a"] != nil || c.graveyard.entries["b"] == nil || c.graveyard.entries["c"] == nil {
+		t.Fatal("the first buried wasn't the one dropped")
+	}
+
+	if c.graveyard.bytes != 20 {
+		t.Fatal(fmt.Sprintf("graveyard holds %d bytes, want 20", c.graveyard.bytes))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// kept first when a response has to be cut down to the
+// header limit, since serving without them would be wrong
+var essentialHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Cache-Control",
+	"Expires",
+	"Vary",
+	"ETag",
+	"Last-Modified",
+}
+
+func countHeaders(h http.Header) int {
+	n := 0
+	for _, vv := range h {
+		n += len(vv)
+	}
+
+	return n
+}
+
+func truncateHeaders(h http.Header, max int) http.Header {
+	kept := make(http.Header)
+	n := 0
+
+	keep := func(name string) {
+		for _, v := range h[name] {
+			if n == max {
+				return
+			}
+
+			kept[name] = append(kept[name], v)
+			n += 1
+		}
+	}
+
+	for _, name := range essentialHeaders {
+		keep(http.CanonicalHeaderKey(name))
+	}
+
+	var rest []string
+	for name := range h {
+		if kept[name] == nil {
+			rest = append(rest, name)
+		}
+	}
+
+	sort.Strings(rest)
+	for _, name := range rest {
+		keep(name)
+	}
+
+	return kept
+}
+
+// an origin sending thousands of headers shouldn't get
+// to have them all held in memory and replayed, returns
+// false if the response should not be cached
+func limitHeaders(o *options, req *http.Request, cr *CachedResponse) bool {
+	n := countHeaders(cr.Header)
+	if *o.MaxCachedHeaders <= 0 || n <= *o.MaxCachedHeaders {
+		return true
+	}
+
+	if *o.TruncateHeaders {
+		log.Println(fmt.Sprintf("truncating %d headers to %d for %s", n, *o.MaxCachedHeaders, req.URL))
+		cr.Header = truncateHeaders(cr.Header, *o.MaxCachedHeaders)
+		return true
+	}
+
+	log.Println(fmt.Sprintf("not caching %s, %d headers is over the limit of %d", req.URL, n, *o.MaxCachedHeaders))
+	return false
+}
+
+// tells multi-instance deployments which node answered,
+// set before anything else so it is on every response
+func servedBy(nodeID string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-Served-By", nodeID)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func headerList(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	return names
+}
+
+// drops the named headers just before the status line is
+// written, whichever path produced the response
+type strippingWriter struct {
+	http.ResponseWriter
+	names []string
+	wrote bool
+}
+
+func (sw *strippingWriter) WriteHeader(code int) {
+	if !sw.wrote {
+		sw.wrote = true
+		for _, name := range sw.names {
+			sw.Header().Del(name)
+		}
+	}
+
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *strippingWriter) Write(b []byte) (int, error) {
+	if !sw.wrote {
+		sw.WriteHeader(http.StatusOK)
+	}
+
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *strippingWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func stripResponseHeaders(names []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&strippingWriter{ResponseWriter: rw, names: names}, r)
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func manyHeadersOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 50; i++ {
+			rw.Header().Set(fmt.Sprintf("X-Extra-%d", i), "v")
+		}
+		io.WriteString(rw, "body")
+	})
+}
+
+func TestOverHeaderLimitIsNotCached(t *testing.T) {
+	origin := manyHeadersOrigin(t)
+	base, cache := newProxy(t, origin.URL, "-c", "-max-cached-headers", "20")
+
+	res, body := get(t, base+"/a")
+	if body != "body" || res.Header.Get("X-Extra-49") == "" {
+		t.Fatal("the response over the limit wasn't passed on whole")
+	}
+
+	if cachedEntry(t, cache, "/a") != nil {
+		t.Fatal("a response over the header limit was cached")
+	}
+
+	get(t, base+"/a")
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestOverHeaderLimitIsTruncated(t *testing.T) {
+	origin := manyHeadersOrigin(t)
+	base, cache := newProxy(t, origin.URL, "-c", "-max-cached-headers", "20", "-truncate-headers")
+
+	get(t, base+"/a")
+
+	cr := cachedEntry(t, cache, "/a")
+	if cr == nil {
+		t.Fatal("a truncated response wasn't cached")
+	}
+
+	if n := countHeaders(cr.Header); n > 20 {
+		t.Fatal(fmt.Sprintf("%d headers cached, want at most 20", n))
+	}
+
+	res, body := get(t, base+"/a")
+	if body != "body" || res.Header.Get("Content-Type") != "text/plain" || res.Header.Get("Cache-Control") != "max-age=60" {
+		t.Fatal("essential headers were dropped from the truncated response")
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+func TestServedByCarriesTheNodeID(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "body")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-node-id", "edge-7")
+
+	// a miss, a hit and an error
+	for _, path := range []string{"/a", "/a", "/missing"} {
+		res, _ := get(t, base+path)
+		if got := res.Header.Get("X-Served-By"); got != "edge-7" {
+			t.Fatal(fmt.Sprintf("%s has X-Served-By %q, want edge-7", path, got))
+		}
+	}
+}
+
+func TestNoServedByWithoutANodeID(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {})
+	base, _ := newProxy(t, origin.URL)
+
+	if res, _ := get(t, base+"/a"); res.Header.Get("X-Served-By") != "" {
+		t.Fatal("X-Served-By sent without -node-id")
+	}
+}
+
+func leakyOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Server", "origin/1.2.3")
+		rw.Header().Set("X-Powered-By", "php/5")
+		rw.Header().Set("X-Kept", "yes")
+		io.WriteString(rw, "body")
+	})
+}
+
+func TestListedResponseHeadersAreStripped(t *testing.T) {
+	origin := leakyOrigin(t)
+
+	for _, args := range [][]string{
+		{"-strip-response-headers", "server, x-powered-by"},
+		{"-c", "-strip-response-headers", "server, x-powered-by"},
+	} {
+		base, cache := newProxy(t, origin.URL, args...)
+
+		// the miss and then the hit
+		for i := 0; i < 2; i++ {
+			res, _ := get(t, base+"/a")
+			if got := res.Header.Values("Server"); len(got) > 0 {
+				t.Fatal(fmt.Sprintf("%v: Server %q was passed on", args, got))
+			}
+
+			if got := res.Header.Get("X-Powered-By"); got != "" {
+				t.Fatal(fmt.Sprintf("%v: X-Powered-By %q was passed on", args, got))
+			}
+
+			if got := res.Header.Get("X-Kept"); got != "yes" {
+				t.Fatal(fmt.Sprintf("%v: unlisted header was %q", args, got))
+			}
+		}
+
+		if cache == nil {
+			continue
+		}
+
+		if cr := cachedEntry(t, cache, "/a"); cr == nil || cr.Header.Get("Server") != "" {
+			t.Fatal("Server header was cached")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sends raw and reads back one response, reporting
+// whether the proxy then closed the connection
+func http10Request(t *testing.T, base string, raw string) (*http.Response, string, bool) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, raw)
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = br.ReadByte()
+
+	return res, string(body), err == io.EOF
+}
+
+func TestHTTP10ClientGetsAClosedConnection(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "cached")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c")
+	get(t, base+"/page")
+
+	res, body, closed := http10Request(t, base, "GET /page HTTP/1.0\r\nHost: proxy\r\n\r\n")
+
+	if body != "cached" || origin.requests.Load() != 1 {
+		t.Fatal(fmt.Sprintf("wanted a hit, got %q", body))
+	}
+
+	if len(res.TransferEncoding) > 0 {
+		t.Fatal(fmt.Sprintf("HTTP/1.0 client was sent %v", res.TransferEncoding))
+	}
+
+	if !res.Close || !closed {
+		t.Fatal(fmt.Sprintf("connection left open, Connection: %q", res.Header.Get("Connection")))
+	}
+}
+
+func TestHTTP10KeepAliveIsHonoured(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "cached")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c")
+	get(t, base+"/page")
+
+	res, body, closed := http10Request(t, base, "GET /page HTTP/1.0\r\nHost: proxy\r\nConnection: keep-alive\r\n\r\n")
+
+	if body != "cached" {
+		t.Fatal(fmt.Sprintf("wanted a hit, got %q", body))
+	}
+
+	if len(res.TransferEncoding) > 0 || res.ContentLength != int64(len(body)) {
+		t.Fatal(fmt.Sprintf("kept alive without a length, %v %d", res.TransferEncoding, res.ContentLength))
+	}
+
+	if res.Close || closed {
+		t.Fatal("keep-alive connection was closed")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+type inflightFill struct {
+	Key     string  `json:"key"`
+	Pending float64 `json:"pending_seconds"`
+}
+
+func (c *Cache) inflight(now time.Time) []inflightFill {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	fills := []inflightFill{}
+	for key, cr := range c.cache {
+		if cr.pending() {
+			fills = append(fills, inflightFill{
+				Key:     key,
+				Pending: now.Sub(cr.pendingSince).Seconds(),
+			})
+		}
+	}
+
+	// longest waiting first, they're the ones of interest
+	sort.Slice(fills, func(i, j int) bool {
+		return fills[i].Pending > fills[j].Pending
+	})
+
+	return fills
+}
+
+// gives up on the origin request behind a pending entry.
+// the entry goes so its waiters are let go to try for
+// themselves, rather than waiting on a fill that's stuck
+func (c *Cache) cancelFill(key string) bool {
+	c.lk.Lock()
+	cr := c.cache[key]
+	if cr == nil || !cr.pending() {
+		c.lk.Unlock()
+		return false
+	}
+
+	for _, p := range c.pools {
+		p.remove(key)
+	}
+	delete(c.cache, key)
+	c.untrackVariant(key)
+	c.lk.Unlock()
+
+	if cr.cancel != nil {
+		cr.cancel()
+	}
+	cr.completeUpdate()
+	return true
+}
+
+// GET /_cache/inflight lists entries still being filled,
+// DELETE /_cache/inflight?key=... cancels one of them
+func (a *adminServer) inflight(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(rw, http.StatusOK, a.cache.inflight(time.Now()))
+	case "DELETE":
+		if !a.cache.cancelFill(r.URL.Query().Get("key")) {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": "no fill in flight for that key"})
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
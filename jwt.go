@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// checks JSON web tokens signed with the key in -jwt-key,
+// a PEM public key or certificate for RS and ES tokens, or
+// anything else as the shared secret for HS tokens. the
+// key decides which algorithms are accepted, never the
+// token, so a public key can't be passed off as a secret
+type jwtVerifier struct {
+	key      interface{}
+	issuer   string
+	audience string
+}
+
+func newJWTAuth(o *options) (AuthFunc, error) {
+	raw, err := os.ReadFile(*o.JWTKey)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &jwtVerifier{issuer: *o.JWTIssuer, audience: *o.JWTAudience}
+	if v.key, err = parseJWTKey(raw); err != nil {
+		return nil, err
+	}
+
+	return func(r *http.Request) (map[string]interface{}, error) {
+		token, ok := bearerToken(r)
+		if !ok {
+			return nil, errMissingToken
+		}
+
+		return v.verify(token, time.Now())
+	}, nil
+}
+
+func parseJWTKey(raw []byte) (interface{}, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		secret := bytes.TrimSpace(raw)
+		if len(secret) == 0 {
+			return nil, errors.New("empty -jwt-key")
+		}
+
+		return secret, nil
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("unsupported -jwt-key type %T", key))
+}
+
+func jwtHash(alg string) (crypto.Hash, bool) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, true
+	case "384":
+		return crypto.SHA384, true
+	case "512":
+		return crypto.SHA512, true
+	}
+
+	return 0, false
+}
+
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	if err := v.checkSignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed token")
+	}
+
+	return nil
+}
+
+func (v *jwtVerifier) checkSignature(alg string, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return errors.New(fmt.Sprintf("unsupported token algorithm %q", alg))
+	}
+
+	hash, ok := jwtHash(alg)
+	if !ok {
+		return errors.New(fmt.Sprintf("unsupported token algorithm %q", alg))
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := v.key.(type) {
+	case []byte:
+		if alg[:2] != "HS" {
+			break
+		}
+
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid token signature")
+		}
+
+		return nil
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+
+		if rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return errors.New("invalid token signature")
+		}
+
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+
+		// r and s, each the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid token signature")
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("token algorithm %q doesn't match -jwt-key", alg))
+}
+
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return errors.New("token has expired")
+	} else if _, present := claims["exp"]; present && !ok {
+		return errors.New("malformed token expiry")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return errors.New("token has the wrong issuer")
+	}
+
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return errors.New("token is for a different audience")
+	}
+
+	return nil
+}
+
+// aud may be a single string or a list of them
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, v := range a {
+			if v == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var jwtSecret = []byte("not a very good secret")
+
+func jwtKeyFile(t *testing.T, key []byte) string {
+	path := filepath.Join(t.TempDir(), "jwt.key")
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func jwtSigned(t *testing.T, alg string, claims map[string]interface{}, sign func(signed string) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hs256(t *testing.T, claims map[string]interface{}) string {
+	return jwtSigned(t, "HS256", claims, func(signed string) []byte {
+		mac := hmac.New(crypto.SHA256.New, jwtSecret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	})
+}
+
+// tells whoever asks who the origin was told they are
+func whoamiOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(rw, r.Header.Get("X-User"))
+	})
+}
+
+func jwtProxy(t *testing.T, origin *testOrigin, args ...string) string {
+	base, _ := newProxy(t, origin.URL, append([]string{"-jwt-key", jwtKeyFile(t, jwtSecret)}, args...)...)
+	return base
+}
+
+func expiresIn(d time.Duration) float64 {
+	return float64(time.Now().Add(d).Unix())
+}
+
+func TestValidTokenIsForwarded(t *testing.T) {
+	origin := whoamiOrigin(t)
+	base := jwtProxy(t, origin, "-jwt-claim-headers", "sub=X-User")
+
+	token := hs256(t, map[string]interface{}{"sub": "alice", "exp": expiresIn(time.Hour)})
+	res, body := get(t, base+"/", "Authorization", "Bearer "+token)
+	if res.StatusCode != http.StatusOK || body != "alice" {
+		t.Fatal(fmt.Sprintf("got %d %q, want alice let through", res.StatusCode, body))
+	}
+}
+
+func TestExpiredTokenIsRefused(t *testing.T) {
+	origin := whoamiOrigin(t)
+	base := jwtProxy(t, origin)
+
+	token := hs256(t, map[string]interface{}{"sub": "alice", "exp": expiresIn(-time.Minute)})
+	res, _ := get(t, base+"/", "Authorization", "Bearer "+token)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatal(fmt.Sprintf("got %d, want 401", res.StatusCode))
+	}
+
+	if c := res.Header.Get("WWW-Authenticate"); c != `Bearer error="invalid_token"` {
+		t.Fatal(fmt.Sprintf("WWW-Authenticate %q doesn't say the token was invalid", c))
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal(fmt.Sprintf("origin was asked %d times", n))
+	}
+}
+
+func TestMissingTokenIsRefused(t *testing.T) {
+	origin := whoamiOrigin(t)
+	base := jwtProxy(t, origin)
+
+	for _, auth := range []string{"", "Basic YWxpY2U6c2VjcmV0", "Bearer "} {
+		res, _ := get(t, base+"/", "Authorization", auth)
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Fatal(fmt.Sprintf("Authorization %q got %d with WWW-Authenticate %q", auth, res.StatusCode, res.Header.Get("WWW-Authenticate")))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal(fmt.Sprintf("origin was asked %d times", n))
+	}
+}
+
+func TestClientCantForgeClaimHeaders(t *testing.T) {
+	origin := whoamiOrigin(t)
+	base := jwtProxy(t, origin, "-jwt-claim-headers", "sub=X-User")
+
+	token := hs256(t, map[string]interface{}{"exp": expiresIn(time.Hour)})
+	if _, body := get(t, base+"/", "Authorization", "Bearer "+token, "X-User", "admin"); body != "" {
+		t.Fatal(fmt.Sprintf("origin was told the client is %q", body))
+	}
+}
+
+func TestClaimHeadersKeyEntries(t *testing.T) {
+	origin := whoamiOrigin(t)
+	base := jwtProxy(t, origin, "-c", "-jwt-claim-headers", "sub=X-User")
+
+	alice := hs256(t, map[string]interface{}{"sub": "alice", "exp": expiresIn(time.Hour)})
+	bob := hs256(t, map[string]interface{}{"sub": "bob", "exp": expiresIn(time.Hour)})
+
+	for _, want := range []struct{ token, user string }{{alice, "alice"}, {bob, "bob"}, {alice, "alice"}} {
+		res, body := get(t, base+"/", "Authorization", "Bearer "+want.token)
+		if body != want.user {
+			t.Fatal(fmt.Sprintf("%s got %q", want.user, body))
+		}
+
+		if !varies(res.Header, "X-User") {
+			t.Fatal(fmt.Sprintf("Vary %q doesn't cover X-User", res.Header.Values("Vary")))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin was asked %d times, want once for each user", n))
+	}
+}
+
+func TestAuthHook(t *testing.T) {
+	origin := whoamiOrigin(t)
+	o := testOptions(t, origin.URL, "-jwt-claim-headers", "name=X-User")
+	o.Auth = func(r *http.Request) (map[string]interface{}, error) {
+		if r.Header.Get("X-Api-Key") != "let-me-in" {
+			return nil, errors.New("wrong key")
+		}
+
+		return map[string]interface{}{"name": "service"}, nil
+	}
+	base, _ := startProxy(t, o)
+
+	if res, _ := get(t, base+"/", "X-Api-Key", "guess"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatal(fmt.Sprintf("a wrong key got %d", res.StatusCode))
+	}
+
+	if res, body := get(t, base+"/", "X-Api-Key", "let-me-in"); res.StatusCode != http.StatusOK || body != "service" {
+		t.Fatal(fmt.Sprintf("the right key got %d %q", res.StatusCode, body))
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es256 := func(claims map[string]interface{}) string {
+		return jwtSigned(t, "ES256", claims, func(signed string) []byte {
+			digest := crypto.SHA256.New()
+			digest.Write([]byte(signed))
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest.Sum(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+			return sig
+		})
+	}
+
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	valid := map[string]interface{}{"iss": "sso", "aud": []interface{}{"mirror"}, "exp": expiresIn(time.Hour)}
+
+	tests := []struct {
+		name  string
+		key   []byte
+		token string
+		ok    bool
+	}{
+		{"hs256", jwtSecret, hs256(t, valid), true},
+		{"es256", ecPEM, es256(valid), true},
+		{"wrong secret", []byte("another secret"), hs256(t, valid), false},
+		{"hs256 against a public key", ecPEM, hs256(t, valid), false},
+		{"wrong issuer", jwtSecret, hs256(t, map[string]interface{}{"iss": "other", "aud": "mirror"}), false},
+		{"wrong audience", jwtSecret, hs256(t, map[string]interface{}{"iss": "sso", "aud": "other"}), false},
+		{"not yet valid", jwtSecret, hs256(t, map[string]interface{}{"iss": "sso", "aud": "mirror", "nbf": expiresIn(time.Hour)}), false},
+		{"unsigned", jwtSecret, jwtSigned(t, "none", valid, func(string) []byte { return nil }), false},
+		{"malformed", jwtSecret, "not.a.token", false},
+	}
+
+	for _, test := range tests {
+		key, err := parseJWTKey(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := &jwtVerifier{key: key, issuer: "sso", audience: "mirror"}
+		if _, err := v.verify(test.token, time.Now()); (err == nil) != test.ok {
+			t.Fatal(fmt.Sprintf("%s: got %v", test.name, err))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// with -public-url set, absolute URLs in these headers and
+// in Link that point back at an origin are pointed at the
+// proxy instead, so redirects, preloads and the like stay
+// on its host
+var urlHeaders = []string{"Location", "Content-Location"}
+
+// every host we fetch from, and the one we ask for if
+// -host overrides it
+func originHosts(o *options) map[string]bool {
+	hosts := make(map[string]bool)
+	add := func(u *url.URL) {
+		if u != nil && u.Host != "" {
+			hosts[strings.ToLower(u.Host)] = true
+		}
+	}
+
+	add(o.Target)
+	add(o.ColdOrigin.URL)
+	add(o.HotOrigin.URL)
+	for _, u := range o.FallbackOrigins {
+		add(u)
+	}
+
+	if *o.Host != "" {
+		hosts[strings.ToLower(*o.Host)] = true
+	}
+
+	return hosts
+}
+
+type urlRewriter struct {
+	public *url.URL
+	hosts  map[string]bool
+}
+
+// relative references already resolve against the proxy,
+// and anything on another host is left as it is. a path on
+// -public-url is where the proxy is mounted by whatever is
+// in front of it, so goes ahead of the origin's path
+func (ur *urlRewriter) rewrite(ref string) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil || !u.IsAbs() || !ur.hosts[strings.ToLower(u.Host)] {
+		return ref
+	}
+
+	u.Scheme = ur.public.Scheme
+	u.Host = ur.public.Host
+	if u.RawPath != "" {
+		u.RawPath = strings.TrimSuffix(ur.public.EscapedPath(), "/") + u.EscapedPath()
+	}
+	u.Path = strings.TrimSuffix(ur.public.Path, "/") + u.Path
+	return u.String()
+}
+
+// Link: <https://origin/a.css>; rel=preload, <...>; rel=next
+// only the parts between angle brackets are URLs
+func (ur *urlRewriter) rewriteLink(v string) string {
+	var b strings.Builder
+
+	for {
+		start := strings.IndexByte(v, '<')
+		if start < 0 {
+			break
+		}
+
+		end := strings.IndexByte(v[start:], '>')
+		if end < 0 {
+			break
+		}
+
+		end += start
+		b.WriteString(v[:start+1])
+		b.WriteString(ur.rewrite(v[start+1 : end]))
+		b.WriteByte('>')
+		v = v[end+1:]
+	}
+
+	b.WriteString(v)
+	return b.String()
+}
+
+func (ur *urlRewriter) apply(h http.Header) {
+	for _, name := range urlHeaders {
+		if v := h.Get(name); v != "" {
+			h.Set(name, ur.rewrite(v))
+		}
+	}
+
+	if links := h.Values("Link"); len(links) > 0 {
+		rewritten := make([]string, len(links))
+		for i, v := range links {
+			rewritten[i] = ur.rewriteLink(v)
+		}
+
+		h["Link"] = rewritten
+	}
+}
+
+// rewrites just before the status line is written, so
+// what's cached keeps the origin's URLs
+type urlRewritingWriter struct {
+	http.ResponseWriter
+	rewriter *urlRewriter
+	wrote    bool
+}
+
+func (uw *urlRewritingWriter) WriteHeader(code int) {
+	if !uw.wrote {
+		uw.wrote = true
+		uw.rewriter.apply(uw.Header())
+	}
+
+	uw.ResponseWriter.WriteHeader(code)
+}
+
+func (uw *urlRewritingWriter) Write(b []byte) (int, error) {
+	if !uw.wrote {
+		uw.WriteHeader(http.StatusOK)
+	}
+
+	return uw.ResponseWriter.Write(b)
+}
+
+func (uw *urlRewritingWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+func rewriteOriginURLs(o *options, next http.Handler) http.Handler {
+	ur := &urlRewriter{public: o.PublicURL.URL, hosts: originHosts(o)}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&urlRewritingWriter{ResponseWriter: rw, rewriter: ur}, r)
+	})
+}
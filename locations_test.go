@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// points at itself, and at somewhere else, in every header
+// that can hold a URL
+func linkingOrigin(t *testing.T) *testOrigin {
+	var origin *testOrigin
+	origin = newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Location", origin.URL+"/page.en?v=2")
+		rw.Header().Add("Link", "<"+origin.URL+"/a.css>; rel=preload; as=style, <https://fonts.example.net/f.woff2>; rel=preload")
+		rw.Header().Add("Link", "</next>; rel=next")
+
+		if r.URL.Path == "/old" {
+			rw.Header().Set("Location", origin.URL+"/new")
+			rw.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
+		if r.URL.Path == "/away" {
+			rw.Header().Set("Location", "https://elsewhere.example.org/new")
+			rw.WriteHeader(http.StatusFound)
+		}
+	})
+
+	return origin
+}
+
+func TestOriginURLsPointAtThePublicURL(t *testing.T) {
+	origin := linkingOrigin(t)
+	base, cache := newProxy(t, origin.URL, "-c", "-public-url", "https://www.example.com/mirror/")
+
+	for _, c := range []struct {
+		path   string
+		header string
+		want   []string
+	}{
+		{"/old", "Location", []string{"https://www.example.com/mirror/new"}},
+		{"/old", "Content-Location", []string{"https://www.example.com/mirror/page.en?v=2"}},
+		{"/old", "Link", []string{
+			"<https://www.example.com/mirror/a.css>; rel=preload; as=style, <https://fonts.example.net/f.woff2>; rel=preload",
+			"</next>; rel=next",
+		}},
+		{"/away", "Location", []string{"https://elsewhere.example.org/new"}},
+	} {
+		res, _ := get(t, base+c.path)
+		if got := res.Header.Values(c.header); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Fatal(fmt.Sprintf("%s %s is %q, want %q", c.path, c.header, got, c.want))
+		}
+	}
+
+	// rewritten on the way out, what's kept is the origin's
+	cr := cachedEntry(t, cache, "/old")
+	if cr == nil {
+		t.Fatal("nothing cached for /old")
+	}
+
+	if l := cr.Header.Get("Location"); l != origin.URL+"/new" {
+		t.Fatal(fmt.Sprintf("cached Location is %q", l))
+	}
+
+	// and served from the cache rewritten all the same
+	if res, _ := get(t, base+"/old"); res.Header.Get("Location") != "https://www.example.com/mirror/new" {
+		t.Fatal(fmt.Sprintf("cached Location served as %q", res.Header.Get("Location")))
+	}
+}
+
+func TestOriginURLsAreLeftAloneByDefault(t *testing.T) {
+	origin := linkingOrigin(t)
+	base, _ := newProxy(t, origin.URL)
+
+	if res, _ := get(t, base+"/old"); res.Header.Get("Location") != origin.URL+"/new" {
+		t.Fatal(fmt.Sprintf("Location is %q", res.Header.Get("Location")))
+	}
+}
+
+func TestURLRewriter(t *testing.T) {
+	public, _ := url.Parse("https://www.example.com/mirror")
+	ur := &urlRewriter{public: public, hosts: map[string]bool{"origin.internal:8080": true}}
+
+	for ref, want := range map[string]string{
+		"http://origin.internal:8080/a?b=c#d":   "https://www.example.com/mirror/a?b=c#d",
+		"http://ORIGIN.internal:8080/a":         "https://www.example.com/mirror/a",
+		"http://origin.internal:8080/a%2Fb":     "https://www.example.com/mirror/a%2Fb",
+		"http://origin.internal:8080":           "https://www.example.com/mirror",
+		"http://origin.internal/a":              "http://origin.internal/a",
+		"https://third-party.example.net/a":     "https://third-party.example.net/a",
+		"/relative/path":                        "/relative/path",
+		"http://origin.internal:8080/%zz-bogus": "http://origin.internal:8080/%zz-bogus",
+	} {
+		if got := ur.rewrite(ref); got != want {
+			t.Fatal(fmt.Sprintf("%q rewrote to %q, want %q", ref, got, want))
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// turned away before the cache is looked at or the origin
+// dialled, e.g. to keep a mirror to GET,HEAD
+func allowMethods(allowed string, next http.Handler) http.Handler {
+	methods := make(map[string]bool)
+	var list []string
+
+	for _, m := range strings.Split(allowed, ",") {
+		if m = strings.ToUpper(strings.TrimSpace(m)); m != "" && !methods[m] {
+			methods[m] = true
+			list = append(list, m)
+		}
+	}
+
+	allow := strings.Join(list, ", ")
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !methods[r.Method] {
+			rw.Header().Set("Allow", allow)
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestDisallowedMethodIsTurnedAway(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, r.Method)
+	})
+
+	base, _ := newProxy(t, origin.URL, "-allowed-methods", "get, HEAD")
+
+	res, _ := request(t, "POST", base+"/a")
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal(fmt.Sprintf("POST got %d, want 405", res.StatusCode))
+	}
+
+	if allow := res.Header.Get("Allow"); allow != "GET, HEAD" {
+		t.Fatal(fmt.Sprintf("Allow %q, want GET, HEAD", allow))
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal("a disallowed POST reached the origin")
+	}
+
+	if res, body := get(t, base+"/a"); res.StatusCode != http.StatusOK || body != "GET" {
+		t.Fatal(fmt.Sprintf("GET got %d %q", res.StatusCode, body))
+	}
+}
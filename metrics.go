@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const windowSlots = 12
+
+type windowSlot struct {
+	epoch  int64
+	hits   int64
+	misses int64
+}
+
+// hit/miss counts over roughly the last window, kept as a
+// ring of sub-windows that are reset as they come around
+type hitWindow struct {
+	lk    sync.Mutex
+	width time.Duration
+	slots [windowSlots]windowSlot
+}
+
+func newHitWindow(window time.Duration) *hitWindow {
+	width := window / windowSlots
+	if width <= 0 {
+		width = time.Second
+	}
+
+	return &hitWindow{width: width}
+}
+
+func (w *hitWindow) record(now time.Time, hit bool) {
+	epoch := now.UnixNano() / int64(w.width)
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	slot := &w.slots[epoch%windowSlots]
+	if slot.epoch != epoch {
+		*slot = windowSlot{epoch: epoch}
+	}
+
+	if hit {
+		slot.hits += 1
+	} else {
+		slot.misses += 1
+	}
+}
+
+// -1 when there has been no traffic in the window
+func (w *hitWindow) ratio(now time.Time) float64 {
+	epoch := now.UnixNano() / int64(w.width)
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	var hits, total int64
+	for _, slot := range w.slots {
+		if slot.epoch > epoch-windowSlots {
+			hits += slot.hits
+			total += slot.hits + slot.misses
+		}
+	}
+
+	if total == 0 {
+		return -1
+	}
+
+	return float64(hits) / float64(total)
+}
+
+type cacheStats struct {
+	hits       atomic.Int64
+	misses     atomic.Int64
+	bytesSaved atomic.Int64
+	window     *hitWindow
+}
+
+func (s *cacheStats) hit(served int) {
+	s.hits.Add(1)
+	s.bytesSaved.Add(int64(served))
+	s.window.record(time.Now(), true)
+}
+
+func (s *cacheStats) miss() {
+	s.misses.Add(1)
+	s.window.record(time.Now(), false)
+}
+
+// zeroes the counters, what the cache holds is untouched
+func (s *cacheStats) reset() {
+	s.hits.Store(0)
+	s.misses.Store(0)
+	s.bytesSaved.Store(0)
+
+	s.window.lk.Lock()
+	s.window.slots = [windowSlots]windowSlot{}
+	s.window.lk.Unlock()
+}
+
+// live gauges of what the cache is holding
+func (c *Cache) usage() (entries int, bytes int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	for _, p := range c.pools {
+		entries += p.entries
+		bytes += p.bytes
+	}
+
+	return entries, bytes
+}
+
+func (a *adminServer) metrics(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := a.cache.stats
+	hits := stats.hits.Load()
+	misses := stats.misses.Load()
+
+	ratio := float64(-1)
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+
+	entries, bytes := a.cache.usage()
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"hits":             hits,
+		"misses":           misses,
+		"bytes_saved":      stats.bytesSaved.Load(),
+		"hit_ratio":        ratio,
+		"window_hit_ratio": stats.window.ratio(time.Now()),
+		"entries":          entries,
+		"bytes":            bytes,
+	})
+}
+
+func (a *adminServer) resetMetrics(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.cache.stats.reset()
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHitWindowSlidesPastOldTraffic(t *testing.T) {
+	w := newHitWindow(12 * time.Second)
+	start := time.Unix(1000000, 0)
+
+	if r := w.ratio(start); r != -1 {
+		t.Fatal(fmt.Sprintf("ratio %v with no traffic, want -1", r))
+	}
+
+	for i := 0; i < 10; i++ {
+		w.record(start, true)
+	}
+
+	if r := w.ratio(start); r != 1 {
+		t.Fatal(fmt.Sprintf("ratio %v after only hits, want 1", r))
+	}
+
+	later := start.Add(6 * time.Second)
+	for i := 0; i < 10; i++ {
+		w.record(later, false)
+	}
+
+	if r := w.ratio(later); r != 0.5 {
+		t.Fatal(fmt.Sprintf("ratio %v after as many misses as hits, want 0.5", r))
+	}
+
+	// the hits have left the window, the misses haven't
+	if r := w.ratio(start.Add(13 * time.Second)); r != 0 {
+		t.Fatal(fmt.Sprintf("ratio %v once the hits are a window old, want 0", r))
+	}
+
+	if r := w.ratio(start.Add(time.Minute)); r != -1 {
+		t.Fatal(fmt.Sprintf("ratio %v once everything is a window old, want -1", r))
+	}
+}
+
+func metrics(t *testing.T, base string) map[string]float64 {
+	t.Helper()
+
+	_, body := admin(t, "GET", base+"/_metrics")
+
+	var m map[string]float64
+	if err := json.Unmarshal([]byte(body), &m); err != nil {
+		t.Fatal(fmt.Sprintf("metrics %q: %s", body, err))
+	}
+
+	return m
+}
+
+func TestWindowHitRatioShiftsWithTraffic(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "body")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-admin-token", testAdminToken)
+
+	for i := 0; i < 4; i++ {
+		get(t, base+"/hot")
+	}
+
+	if r := metrics(t, base)["window_hit_ratio"]; r != 0.75 {
+		t.Fatal(fmt.Sprintf("window_hit_ratio %v after a miss and three hits, want 0.75", r))
+	}
+
+	for _, path := range []string{"/b", "/c", "/d", "/e"} {
+		get(t, base+path)
+	}
+
+	if r := metrics(t, base)["window_hit_ratio"]; r != 0.375 {
+		t.Fatal(fmt.Sprintf("window_hit_ratio %v after four more misses, want 0.375", r))
+	}
+}
+
+func TestMetricsResetZeroesCountersOnly(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "body")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-admin-token", testAdminToken)
+
+	get(t, base+"/a")
+	get(t, base+"/a")
+
+	before := metrics(t, base)
+	if before["hits"] != 1 || before["misses"] != 1 || before["bytes_saved"] != 4 {
+		t.Fatal(fmt.Sprintf("metrics %v before the reset", before))
+	}
+
+	if res, _ := request(t, "POST", base+"/_metrics/reset"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatal(fmt.Sprintf("reset without the token got %d, want 401", res.StatusCode))
+	}
+
+	if res, _ := admin(t, "POST", base+"/_metrics/reset"); res.StatusCode/100 != 2 {
+		t.Fatal(fmt.Sprintf("reset got %d", res.StatusCode))
+	}
+
+	after := metrics(t, base)
+	for _, counter := range []string{"hits", "misses", "bytes_saved"} {
+		if after[counter] != 0 {
+			t.Fatal(fmt.Sprintf("%s is %v after the reset, want 0", counter, after[counter]))
+		}
+	}
+
+	if after["window_hit_ratio"] != -1 {
+		t.Fatal(fmt.Sprintf("window_hit_ratio %v after the reset, want -1", after["window_hit_ratio"]))
+	}
+
+	// gauges of what's held and the entries themselves stay
+	if after["entries"] != before["entries"] || after["bytes"] != before["bytes"] {
+		t.Fatal(fmt.Sprintf("gauges went from %v to %v", before, after))
+	}
+
+	get(t, base+"/a")
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal("the reset emptied the cache")
+	}
+}
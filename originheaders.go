@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// repeatable -origin-header host=Name: value, fixed
+// request headers only ever sent to that origin so a
+// token for one backend can't leak to another
+type originHeaders map[string]http.Header
+
+func (oh originHeaders) String() string {
+	var s []string
+	for host, h := range oh {
+		for name, values := range h {
+			for _, v := range values {
+				s = append(s, host+"="+name+": "+v)
+			}
+		}
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (oh originHeaders) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("origin header must be in the form host=Name: value")
+	}
+
+	header := strings.SplitN(parts[1], ":", 2)
+	if len(header) != 2 || strings.TrimSpace(header[0]) == "" {
+		return errors.New("origin header must be in the form host=Name: value")
+	}
+
+	host := strings.ToLower(parts[0])
+	if oh[host] == nil {
+		oh[host] = make(http.Header)
+	}
+
+	oh[host].Add(strings.TrimSpace(header[0]), strings.TrimSpace(header[1]))
+	return nil
+}
+
+// replaces anything the client sent under the same names
+func (oh originHeaders) apply(out *http.Request) {
+	for name, values := range oh[strings.ToLower(out.URL.Host)] {
+		out.Header[name] = append([]string(nil), values...)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// echoes back whatever token it was sent
+func tokenOrigin(t *testing.T, status int) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(status)
+		io.WriteString(rw, r.Header.Get("X-Backend-Token"))
+	})
+}
+
+func originHost(t *testing.T, origin *testOrigin) string {
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Host
+}
+
+func TestOriginHeaderIsSentToItsTarget(t *testing.T) {
+	origin := tokenOrigin(t, http.StatusOK)
+	base, _ := newProxy(t, origin.URL, "-origin-header", originHost(t, origin)+"=X-Backend-Token: secret")
+
+	for _, client := range []string{"", "forged"} {
+		_, body := get(t, base+"/", "X-Backend-Token", client)
+		if body != "secret" {
+			t.Fatal(fmt.Sprintf("client sent %q, origin got %q rather than secret", client, body))
+		}
+	}
+}
+
+func TestOriginHeaderIsNotSentElsewhere(t *testing.T) {
+	origin := tokenOrigin(t, http.StatusOK)
+	other := tokenOrigin(t, http.StatusOK)
+	base, _ := newProxy(t, other.URL, "-origin-header", originHost(t, origin)+"=X-Backend-Token: secret")
+
+	if _, body := get(t, base+"/"); body != "" {
+		t.Fatal(fmt.Sprintf("another target got %q", body))
+	}
+}
+
+func TestOriginHeaderIsNotSentToAFallback(t *testing.T) {
+	origin := tokenOrigin(t, http.StatusNotFound)
+	fallback := tokenOrigin(t, http.StatusOK)
+	base, _ := newProxy(t, origin.URL, "-c",
+		"-origin-header", originHost(t, origin)+"=X-Backend-Token: secret",
+		"-fallback-origin", "/="+fallback.URL)
+
+	res, body := get(t, base+"/")
+	if res.StatusCode != http.StatusOK || fallback.requests.Load() != 1 {
+		t.Fatal(fmt.Sprintf("fallback wasn't used, got %d", res.StatusCode))
+	}
+
+	if body != "" {
+		t.Fatal(fmt.Sprintf("fallback got %q", body))
+	}
+}
+
+func TestOriginHeaderRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "host", "=X-Token: a", "host=X-Token", "host=: a"} {
+		if err := make(originHeaders).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// how long in-flight requests get to finish on shutdown
+// before the cache is written out regardless
+const shutdownDrainTimeout = 10 * time.Second
+
+type persistedEntry struct {
+	Key  string
+	Pool string
+
+	Header     http.Header
+	StatusCode int
+	Body       []byte
+	Gzip       []byte
+	Compressed bool
+	AtRest     bool
+	Length     int
+
+	Stored               time.Time
+	Expires              time.Time
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	Negative             bool
+	NoCache              bool
+
+	HasChecksum  bool
+	Checksum     uint32
+	GzipChecksum uint32
+}
+
+// -persist-file holds the cache between restarts, entries
+// least recently used first so they go back in that order
+type persistedCache struct {
+	Entries []persistedEntry
+	Vary    map[string][]string
+}
+
+func (c *Cache) snapshot() *persistedCache {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	// gob encodes it after the lock is let go, by which
+	// time rekey may be writing to the live map
+	pc := &persistedCache{}
+	if c.vary != nil {
+		pc.Vary = make(map[string][]string, len(c.vary))
+		for base, fields := range c.vary {
+			pc.Vary[base] = fields
+		}
+	}
+
+	for _, p := range c.pools {
+		for el := p.lru.Back(); el != nil; el = el.Prev() {
+			key := el.Value.(*poolItem).key
+			cr := c.cache[key]
+			if cr == nil || cr.pending() {
+				continue
+			}
+
+			pc.Entries = append(pc.Entries, persistedEntry{
+				Key:  key,
+				Pool: p.prefix,
+
+				Header:     cr.Header.Clone(),
+				StatusCode: cr.StatusCode,
+				Body:       cr.Body,
+				Gzip:       cr.Gzip,
+				Compressed: cr.compressed,
+				AtRest:     cr.atRest,
+				Length:     cr.length,
+
+				Stored:               cr.Stored,
+				Expires:              cr.Expires,
+				StaleWhileRevalidate: cr.StaleWhileRevalidate,
+				StaleIfError:         cr.StaleIfError,
+				Negative:             cr.negative,
+				NoCache:              cr.noCache,
+
+				HasChecksum:  cr.hasChecksum,
+				Checksum:     cr.checksum,
+				GzipChecksum: cr.gzipChecksum,
+			})
+		}
+	}
+
+	return pc
+}
+
+// written alongside and renamed into place, a crash part
+// way through leaves the last good file
+func (c *Cache) persist(name string) error {
+	pc := c.snapshot()
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(pc); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("persisted %d cache entries to %s", len(pc.Entries), name))
+	return nil
+}
+
+// a missing file is a cold start rather than an error.
+// anything that has expired since is left out, entries go
+// to the pool they were in if it still exists
+func (c *Cache) load(name string, now time.Time) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pc persistedCache
+	if err := gob.NewDecoder(f).Decode(&pc); err != nil {
+		return err
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.vary != nil && pc.Vary != nil {
+		c.vary = pc.Vary
+	}
+
+	pools := make(map[string]*cachePool)
+	for _, p := range c.pools {
+		pools[p.prefix] = p
+	}
+
+	restored := 0
+	for _, e := range pc.Entries {
+		if !e.Expires.IsZero() && !now.Before(e.Expires) {
+			continue
+		}
+
+		p := pools[e.Pool]
+		if p == nil {
+			p = pools[""]
+		}
+
+		cr := &CachedResponse{
+			Header:     e.Header,
+			StatusCode: e.StatusCode,
+			Body:       e.Body,
+			Gzip:       e.Gzip,
+			compressed: e.Compressed,
+			atRest:     e.AtRest,
+			length:     e.Length,
+
+			Stored:               e.Stored,
+			Expires:              e.Expires,
+			StaleWhileRevalidate: e.StaleWhileRevalidate,
+			StaleIfError:         e.StaleIfError,
+			negative:             e.Negative,
+			noCache:              e.NoCache,
+
+			hasChecksum:  e.HasChecksum,
+			checksum:     e.Checksum,
+			gzipChecksum: e.GzipChecksum,
+		}
+
+		// gob gives back nil for an empty body, which
+		// would read as one that couldn't be
+		if cr.Body == nil && !cr.atRest {
+			cr.Body = []byte{}
+		}
+
+		p.remove(e.Key)
+		c.cache[e.Key] = cr
+		p.add(e.Key)
+		c.trackVariant(e.Key)
+		p.resize(e.Key, cr.size())
+		c.evict(p, "")
+		restored++
+	}
+
+	log.Println(fmt.Sprintf("restored %d cache entries from %s", restored, name))
+	return nil
+}
+
+// drains and persists on SIGINT or SIGTERM
+func persistOnShutdown(srv *http.Server, cache *Cache, name string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	signal.Stop(sig)
+
+	drainAndPersist(srv, cache, name)
+}
+
+// stops taking requests, lets those underway finish, then
+// writes the cache out
+func drainAndPersist(srv *http.Server, cache *Cache, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownDrainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println(fmt.Sprintf("gave up waiting on requests at shutdown: %s", err))
+	}
+
+	if err := cache.persist(name); err != nil {
+		log.Println(fmt.Sprintf("failed to persist cache to %s: %s", name, err))
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// /slow is held until released, the rest answer at once
+func persistOrigin(t *testing.T, release chan struct{}) *testOrigin {
+	var version atomic.Int64
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		fmt.Fprintf(rw, "%s v%d", r.URL.Path, version.Add(1))
+	})
+}
+
+func TestPersistsOnShutdownAndReloads(t *testing.T) {
+	logged := captureLog(t)
+	release := make(chan struct{})
+	origin := persistOrigin(t, release)
+	file := filepath.Join(t.TempDir(), "cache.gob")
+
+	o := testOptions(t, origin.URL, "-c", "-persist-file", file)
+	handler, cache := newProxyHandler(o)
+	ln := listen(o)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	base := "http://" + ln.Addr().String()
+
+	_, a := get(t, base+"/a")
+	get(t, base+"/expired")
+	age(t, cache, "/expired", 2*time.Hour)
+
+	// still underway when shutdown starts, it gets to
+	// finish and goes in the file too
+	slow := make(chan string)
+	go func() {
+		_, body := get(t, base+"/slow")
+		slow <- body
+	}()
+
+	waitFor(t, "the slow request to reach the origin", 5*time.Second, func() bool {
+		return origin.requests.Load() == 3
+	})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+
+	drainAndPersist(srv, cache, file)
+	slowBody := <-slow
+
+	if !strings.Contains(logged.String(), "persisted 3 cache entries") {
+		t.Fatal(fmt.Sprintf("log %q doesn't say 3 entries were persisted", logged.String()))
+	}
+
+	base, restored := newProxy(t, origin.URL, "-c", "-persist-file", file)
+	if !strings.Contains(logged.String(), "restored 2 cache entries") {
+		t.Fatal(fmt.Sprintf("log %q doesn't say 2 entries were restored", logged.String()))
+	}
+
+	if cachedEntry(t, restored, "/expired") != nil {
+		t.Fatal("an expired entry was restored")
+	}
+
+	for path, want := range map[string]string{"/a": a, "/slow": slowBody} {
+		if _, body := get(t, base+path); body != want {
+			t.Fatal(fmt.Sprintf("%s got %q after the restart, want %q", path, body, want))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, the restored entries should have been served", n))
+	}
+}
+
+func TestPersistKeepsCompressedAtRestEntries(t *testing.T) {
+	captureLog(t)
+	css := strings.Repeat("body { color: red; }\n", 200)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Header().Set("Content-Type", "text/css")
+		io.WriteString(rw, css)
+	})
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	args := []string{"-c", "-precompress", "text/css", "-compress-at-rest", "-persist-file", file}
+
+	base, cache := newProxy(t, origin.URL, args...)
+	get(t, base+"/site.css")
+	if err := cache.persist(file); err != nil {
+		t.Fatal(err)
+	}
+
+	base, _ = newProxy(t, origin.URL, args...)
+	if _, body := get(t, base+"/site.css"); body != css {
+		t.Fatal("identity client didn't get the restored body")
+	}
+
+	if _, body := get(t, base+"/site.css", "Accept-Encoding", "gzip"); gunzip(t, body) != css {
+		t.Fatal("gzip client didn't get the restored body")
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+func TestMissingPersistFileIsAColdStart(t *testing.T) {
+	logged := captureLog(t)
+	origin := persistOrigin(t, nil)
+	file := filepath.Join(t.TempDir(), "cache.gob")
+
+	base, _ := newProxy(t, origin.URL, "-c", "-persist-file", file)
+	if res, _ := get(t, base+"/a"); res.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Sprintf("got %d", res.StatusCode))
+	}
+
+	if strings.Contains(logged.String(), "failed") {
+		t.Fatal(fmt.Sprintf("a missing file was logged as a failure: %q", logged.String()))
+	}
+}
+
+func TestCorruptPersistFileIsAColdStart(t *testing.T) {
+	logged := captureLog(t)
+	origin := persistOrigin(t, nil)
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	if err := os.WriteFile(file, []byte("not a cache"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	base, _ := newProxy(t, origin.URL, "-c", "-persist-file", file)
+	if res, _ := get(t, base+"/a"); res.StatusCode != http.StatusOK {
+		t.Fatal(fmt.Sprintf("got %d", res.StatusCode))
+	}
+
+	if !strings.Contains(logged.String(), "failed to restore cache") {
+		t.Fatal(fmt.Sprintf("log %q doesn't say the file couldn't be read", logged.String()))
+	}
+}
+
+func TestPersistDoesntRaceVaryUpdates(t *testing.T) {
+	captureLog(t)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Header().Set("Vary", "Accept-Language")
+	})
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	base, cache := newProxy(t, origin.URL, "-c", "-key-on-vary")
+
+	// every new URL adds to what's known to vary while
+	// the cache is written out, go test -race catches a
+	// snapshot sharing the map rekey writes to
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			get(t, fmt.Sprintf("%s/page-%d", base, i))
+		}
+	}()
+
+	for persisting := true; persisting; {
+		select {
+		case <-done:
+			persisting = false
+		default:
+		}
+
+		if err := cache.persist(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
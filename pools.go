@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a pool owns every cached entry whose path falls under
+// its prefix and evicts least recently used entries once
+// it goes over either of its limits (0 is unlimited), so
+// one kind of traffic can't push out another
+type cachePool struct {
+	prefix     string
+	maxEntries int
+	maxBytes   int
+
+	entries int
+	bytes   int
+	lru     *list.List
+	items   map[string]*list.Element
+}
+
+type poolItem struct {
+	key  string
+	size int
+	used time.Time
+}
+
+func newCachePool(prefix string, maxEntries int, maxBytes int) *cachePool {
+	return &cachePool{
+		prefix:     prefix,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// /images/=100:52428800,/api/=1000:0
+func parsePools(s string) ([]*cachePool, error) {
+	var pools []*cachePool
+
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+
+		parts := strings.SplitN(def, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, errors.New(fmt.Sprintf("invalid cache pool %q", def))
+		}
+
+		limits := strings.SplitN(parts[1], ":", 2)
+		if len(limits) != 2 {
+			return nil, errors.New(fmt.Sprintf("invalid cache pool limits %q", def))
+		}
+
+		maxEntries, err := strconv.Atoi(limits[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid cache pool max entries %q", def))
+		}
+
+		maxBytes, err := strconv.Atoi(limits[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid cache pool max bytes %q", def))
+		}
+
+		pools = append(pools, newCachePool(parts[0], maxEntries, maxBytes))
+	}
+
+	// everything else lands in an unlimited default pool
+	return append(pools, newCachePool("", 0, 0)), nil
+}
+
+func (p *cachePool) add(key string) {
+	p.items[key] = p.lru.PushFront(&poolItem{key: key, used: time.Now()})
+	p.entries += 1
+}
+
+func (p *cachePool) remove(key string) {
+	if el := p.items[key]; el != nil {
+		p.lru.Remove(el)
+		delete(p.items, key)
+		p.entries -= 1
+		p.bytes -= el.Value.(*poolItem).size
+	}
+}
+
+func (p *cachePool) touch(key string) {
+	if el := p.items[key]; el != nil {
+		p.lru.MoveToFront(el)
+		el.Value.(*poolItem).used = time.Now()
+	}
+}
+
+func (p *cachePool) resize(key string, size int) {
+	if el := p.items[key]; el != nil {
+		item := el.Value.(*poolItem)
+		p.bytes += size - item.size
+		item.size = size
+	}
+}
+
+func (p *cachePool) overLimit() bool {
+	return (p.maxEntries > 0 && p.entries > p.maxEntries) ||
+		(p.maxBytes > 0 && p.bytes > p.maxBytes)
+}
+
+// must be called with the cache lock held
+func (c *Cache) pool(req *http.Request) *cachePool {
+	var match *cachePool
+
+	for _, p := range c.pools {
+		if strings.HasPrefix(req.URL.Path, p.prefix) && (match == nil || len(p.prefix) > len(match.prefix)) {
+			match = p
+		}
+	}
+
+	return match
+}
+
+// candidate is the key that just went in, if any. with
+// admission on it only pushes out the least recently used
+// entry if it has been asked for more often, otherwise it
+// is the one that goes. must be called with the cache
+// lock held
+func (c *Cache) evict(p *cachePool, candidate string) {
+	for p.overLimit() {
+		el := p.lru.Back()
+		if el == nil {
+			return
+		}
+
+		item := el.Value.(*poolItem)
+		key := item.key
+
+		if c.sketch != nil && candidate != "" && candidate != key &&
+			c.sketch.estimate(candidate) <= c.sketch.estimate(key) {
+			key = candidate
+		}
+
+		if key == candidate {
+			candidate = ""
+		} else {
+			c.bury(key, item.used, time.Now())
+		}
+
+		p.remove(key)
+		delete(c.cache, key)
+		delete(c.segments, key)
+		c.untrackVariant(key)
+	}
+}
+
+// once a response has been stored its size counts
+// towards its pool, which may push older entries out
+func (c *Cache) Account(req *http.Request, cr *CachedResponse) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	key := c.key(req)
+	if c.cache[key] != cr {
+		return
+	}
+
+	key = c.rekey(req, key, cr)
+	c.limitVariants(req, key)
+
+	p := c.pool(req)
+	p.resize(key, cr.size())
+	c.evict(p, key)
+}
+
+// swaps old for cr only if old is still the entry held,
+// so a slow refresh can't clobber something newer. old is
+// left untouched for whoever is still serving it
+func (c *Cache) Replace(req *http.Request, old *CachedResponse, cr *CachedResponse) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	key := c.key(req)
+	if c.cache[key] != old {
+		return
+	}
+
+	c.cache[key] = cr
+	key = c.rekey(req, key, cr)
+
+	p := c.pool(req)
+	p.resize(key, cr.size())
+	c.evict(p, "")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestFillingOnePoolLeavesAnotherAlone(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, r.URL.Path)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-pools", "/images=3:0,/api=10:0")
+
+	get(t, base+"/api/users")
+	get(t, base+"/api/orders")
+
+	for i := 0; i < 20; i++ {
+		get(t, base+fmt.Sprintf("/images/%d.png", i))
+	}
+
+	for _, path := range []string{"/api/users", "/api/orders"} {
+		if cachedEntry(t, cache, path) == nil {
+			t.Fatal(path + " was evicted by the images pool filling up")
+		}
+	}
+
+	held := 0
+	for i := 0; i < 20; i++ {
+		if cachedEntry(t, cache, fmt.Sprintf("/images/%d.png", i)) != nil {
+			held++
+		}
+	}
+
+	if held != 3 {
+		t.Fatal(fmt.Sprintf("images pool holds %d entries, want its limit of 3", held))
+	}
+
+	// the most recent images are the ones kept
+	if cachedEntry(t, cache, "/images/19.png") == nil {
+		t.Fatal("most recently used image was evicted")
+	}
+}
+
+func TestPoolByteLimit(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "0123456789")
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-pools", "/small=0:25")
+
+	get(t, base+"/small/a")
+	get(t, base+"/small/b")
+	get(t, base+"/small/c")
+
+	if cachedEntry(t, cache, "/small/a") != nil {
+		t.Fatal("oldest entry kept past the pool's byte limit")
+	}
+
+	if cachedEntry(t, cache, "/small/b") == nil || cachedEntry(t, cache, "/small/c") == nil {
+		t.Fatal("entries within the pool's byte limit were evicted")
+	}
+}
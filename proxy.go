@@ -1,29 +1,42 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/sonewman/rox"
+	"hash/crc32"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func main() {
-	host := flag.String("host", "", "define host to be forwarded")
 	address := flag.String("address", ":8080", "define address proxy will run on")
 	//cookieDomain := flag.String("domain", "", "define cookie domain")
 	//followProtocol := flag.Bool("r", false, "should retain scheme on redirect")
-	cache := flag.Bool("c", false, "caches responses")
-	log := flag.Bool("l", false, "log incoming request")
-	ttl := flag.Int("ttl", -1, "cache TTL")
+	upstreamIdleTimeout := flag.Duration("upstream-idle-timeout", 0, "close pooled upstream connections idle for this long, 0 keeps the transport default")
+	expectContinueTimeout := flag.Duration("expect-continue-timeout", 0, "send the body anyway if the origin hasn't answered 100-continue within this long, 0 keeps the transport default")
+	selftest := flag.Bool("selftest", false, "run the proxy as configured against a built in origin, report hit ratio, latency and memory, then exit")
+	selftestRequests := flag.Int("selftest-requests", 10000, "requests the self-test sends")
+	selftestConcurrency := flag.Int("selftest-concurrency", 16, "requests the self-test has in flight at once")
+	o := defineFlags(flag.CommandLine)
 
 	flag.Parse()
 
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		tuneTransport(t, *upstreamIdleTimeout, *expectContinueTimeout)
+	}
+
 	//	if *cookieDomain == "" {
 	//		cookieDomain = host
 	//	}
@@ -39,130 +52,1202 @@ func main() {
 				panic(err)
 			}
 
-			target = u
-		}
+			target = u
+		}
+	}
+
+	addresses := strings.Split(*address, ",")
+	al := len(addresses)
+	i := 0
+
+	// each address has a cache of its own, they'd only
+	// write over each other
+	if *o.PersistFile != "" && al > 1 {
+		panic(errors.New("-persist-file can't be used with more than one address"))
+	}
+
+	for _, add := range addresses {
+		opts := *o
+		opts.Target = target
+		opts.Address = add
+
+		if *selftest {
+			runSelftest(&opts, os.Stdout, *selftestRequests, *selftestConcurrency)
+			return
+		}
+
+		i += 1
+		if i == al {
+			createProxy(&opts)
+		} else {
+			go createProxy(&opts)
+		}
+	}
+}
+
+// zero leaves a setting as the transport had it
+func tuneTransport(t *http.Transport, idle time.Duration, expectContinue time.Duration) {
+	// backends that recycle connections reset the ones we
+	// keep around, so stop reusing them before they do
+	if idle > 0 {
+		t.IdleConnTimeout = idle
+	}
+
+	// how long to hold a body back waiting for the origin
+	// to answer Expect: 100-continue before sending it anyway
+	if expectContinue > 0 {
+		t.ExpectContinueTimeout = expectContinue
+	}
+}
+
+// every flag that ends up in options, on fs so a test can
+// build them from arguments of its own
+func defineFlags(fs *flag.FlagSet) *options {
+	host := fs.String("host", "", "define host to be forwarded")
+	cache := fs.Bool("c", false, "caches responses")
+	log := fs.Bool("l", false, "log incoming request")
+	ttl := fs.Int("ttl", -1, "cache TTL in seconds for responses without s-maxage or max-age")
+	writeTimeout := fs.Duration("write-timeout", 0, "abort writing a cached response to a client after this long")
+	precompress := fs.String("precompress", "", "comma separated content types to store gzipped alongside the identity body")
+	compressMinSize := fs.Int("compress-min-size", 1024, "smallest body in bytes to serve gzipped")
+	precompressMaxSize := fs.Int("precompress-max-size", 1<<20, "largest body in bytes to precompress")
+	cacheRanges := fs.Bool("cache-ranges", false, "cache single range requests as segments of the full object")
+	cachePools := fs.String("cache-pools", "", "comma separated path pools with their own limits, as prefix=max-entries:max-bytes")
+	staleWhileRevalidate := fs.Duration("stale-while-revalidate", 0, "serve expired entries for this long while they are refreshed in the background")
+	staleIfError := fs.Duration("stale-if-error", 0, "serve expired entries for this long when the origin errors")
+	rewriteBody := &bodyRewrites{}
+	fs.Var(rewriteBody, "rewrite-body", "rewrite text bodies before caching, as from=>to (repeatable)")
+	proxyProtocol := fs.Bool("proxy-protocol", false, "expect a PROXY protocol v1/v2 header on every connection")
+	upstreamGzip := fs.Bool("upstream-gzip", false, "always ask the origin for gzip when filling the cache, whatever the client accepts")
+	maxCachedHeaders := fs.Int("max-cached-headers", 0, "most header lines a cached response may carry, 0 is unlimited")
+	truncateHeaders := fs.Bool("truncate-headers", false, "cut responses over -max-cached-headers down to the limit instead of not caching them")
+	nodeID := fs.String("node-id", "", "identify this instance in an X-Served-By response header")
+	verifyChecksum := fs.Bool("verify-checksum", false, "checksum cached bodies and refetch any that no longer match when served")
+	varyDevice := fs.Bool("vary-device", false, "cache separate copies per device class derived from the User-Agent")
+	deviceClasses := fs.String("device-classes", defaultDeviceClasses, "ordered device classes as class=token|token, matched against the User-Agent")
+	refreshWorkers := fs.Int("refresh-workers", 4, "most background refreshes to run at once")
+	varyCookies := fs.String("vary-cookies", "", "comma separated cookies to key on, allowing Vary: Cookie responses to be cached")
+	bypassAuthorized := fs.Bool("bypass-authorized", false, "send requests with an Authorization header straight to the origin, caching only public responses")
+	statusTTL := statusTTLs{}
+	fs.Var(statusTTL, "status-ttl", "cache TTL in seconds per status code in place of -ttl, as status=ttl,...")
+	allowedMethods := fs.String("allowed-methods", "", "comma separated methods to forward, anything else gets a 405")
+	trailingSlash := fs.String("trailing-slash", "", "redirect paths to a canonical form, either add or strip a trailing slash")
+	originHeader := originHeaders{}
+	fs.Var(originHeader, "origin-header", "request header only sent to one origin, as host=Name: value (repeatable)")
+	validateFreshness := fs.Bool("validate-freshness", false, "refetch each entry once in the background while fresh and warn if the origin's body has changed")
+	stripResponseHeaders := fs.String("strip-response-headers", "", "comma separated headers to remove from responses, e.g. Server,X-Powered-By")
+	admission := fs.Bool("admission", false, "only let a new entry into a full cache pool if it's requested more often than the entry it would evict")
+	keyOnVary := fs.Bool("key-on-vary", false, "store a variant per value of the request headers named in the origin's Vary")
+	prefetchFullOnRange := fs.Bool("prefetch-full-on-range", false, "fetch and cache the whole object in the background after serving a range of it")
+	indexContentLocation := fs.Bool("index-content-location", false, "also cache responses under their same-origin Content-Location")
+	maxVariants := fs.Int("max-variants", 0, "most variants of one URL to keep, least recently used go first, 0 is unlimited")
+	fallbackOrigin := fallbackOrigins{}
+	fs.Var(fallbackOrigin, "fallback-origin", "origin to try when the origin 404s a path under prefix, as /prefix=http://host (repeatable)")
+	serverTiming := fs.Bool("server-timing", false, "add a Server-Timing header with cache lookup and origin durations")
+	cacheRoute := cacheRoutes{}
+	fs.Var(cacheRoute, "cache-routes", "turn caching on or off under path prefixes regardless of -c, as /static=on,/api=off")
+	noCacheBody := &bodyFilters{}
+	fs.Var(noCacheBody, "no-cache-body", "regular expression, responses with a matching body are served but not cached (repeatable)")
+	synthetic := &syntheticResponses{}
+	fs.Var(synthetic, "synthetic", "answer a path without the origin, as /path=status:body or /prefix*=status:@file (repeatable)")
+	evictionGrace := fs.Duration("eviction-grace", 0, "keep entries evicted while in use for this long so a request for them restores them")
+	evictionGraceMaxBytes := fs.Int("eviction-grace-max-bytes", 16<<20, "most bytes of evicted entries to keep for -eviction-grace, oldest dropped first")
+	warmupFile := fs.String("warmup-file", "", "file of paths, one per line, to request at startup, /_readyz returns 503 until done")
+	warmupTimeout := fs.Duration("warmup-timeout", time.Minute, "report ready after this long even if warmup hasn't finished, 0 waits for it")
+	cacheErrorsTTL := fs.Duration("cache-errors-ttl", 0, "cache 5xx responses for this long, whatever their headers say, and never serve them stale")
+	coalesceHead := fs.Bool("coalesce-head", false, "answer HEAD from a cached or in-flight GET for the same URL")
+	minRevalidateInterval := fs.Duration("min-revalidate-interval", 0, "serve no-cache responses from the cache for this long before checking with the origin again")
+	expectContinue := fs.String("expect-continue", "forward", "forward Expect: 100-continue to the origin, or handle it locally")
+	rejectAmbiguous := fs.Bool("reject-ambiguous-framing", true, "answer 400 to requests with both Content-Length and Transfer-Encoding or conflicting lengths")
+	clientCacheControl := clientCacheControls{}
+	fs.Var(clientCacheControl, "client-cache-control", "Cache-Control to send clients under a path prefix in place of the origin's, as /prefix=max-age=60 (repeatable)")
+	keyHeaders := fs.String("key-headers", "", "comma separated request headers whose values are part of the cache key, e.g. X-Region")
+	beacon := &beaconRoutes{}
+	fs.Var(beacon, "beacon", "answer a 204 endpoint locally once the origin has, as /path or /prefix* (repeatable)")
+	upstreamScheme := fs.String("upstream-scheme", "", "scheme to reach the origin with, http or https, defaults to the target's rather than the client's")
+	bufferTimeout := fs.Duration("buffer-timeout", 0, "stream a response through uncached if its whole body hasn't arrived within this long, 0 waits for it")
+	cacheSizeRange := sizeRanges{}
+	fs.Var(cacheSizeRange, "cache-size-range", "only cache bodies within min-max bytes, either end optional, or /prefix=min-max for a route (repeatable)")
+	logFormat := fs.String("log-format", "", "write an access log line per request to stdout, clf or combined")
+	requestBudget := fs.Duration("request-budget", 0, "serve what's cached, however stale, or 504 if the origin hasn't answered within this long, 0 waits for it")
+	jwtKey := fs.String("jwt-key", "", "require a bearer JWT signed with this PEM public key or certificate, or with the secret in this file")
+	jwtIssuer := fs.String("jwt-issuer", "", "require JWTs to have been issued by this iss")
+	jwtAudience := fs.String("jwt-audience", "", "require JWTs to be meant for this aud")
+	jwtClaimHeader := claimHeaders{}
+	fs.Var(jwtClaimHeader, "jwt-claim-headers", "send JWT claims to the origin as headers, as sub=X-User,email=X-Email")
+	coldOrigin := &originURL{}
+	fs.Var(coldOrigin, "cold-origin", "origin to fetch cache misses from in place of the target")
+	hotOrigin := &originURL{}
+	fs.Var(hotOrigin, "hot-origin", "origin to revalidate and refresh cached entries against in place of the target")
+	compressAtRest := fs.Bool("compress-at-rest", false, "hold only the gzip copy of entries that have one, decompressing for clients that don't accept gzip")
+	requestNoCache := fs.Bool("request-no-cache", true, "revalidate with the origin for clients sending Cache-Control: no-cache, or Pragma: no-cache without Cache-Control")
+	cacheableStatus := cacheableStatuses{}
+	fs.Var(cacheableStatus, "cacheable-status", "statuses to always or never cache, as 301=off,299=on")
+	persistFile := fs.String("persist-file", "", "write the cache to this file on shutdown and load it back on start, leaving out anything that has expired")
+	publicURL := &originURL{}
+	fs.Var(publicURL, "public-url", "point origin URLs in Location, Content-Location and Link at this URL for the proxy")
+	hitWindow := fs.Duration("hit-window", time.Minute, "window over which the recent hit ratio is reported")
+	adminToken := fs.String("admin-token", "", "enable the /_cache admin endpoints, authorised with this bearer token")
+	refetchOnServeError := fs.Bool("refetch-on-serve-error", true, "go to the origin when a cached response can't be read, rather than returning 502")
+
+	return &options{
+		Host:  host,
+		Cache: cache,
+		TTL:   ttl,
+		Log:   log,
+
+		WriteTimeout: writeTimeout,
+
+		Precompress:        precompress,
+		PrecompressMaxSize: precompressMaxSize,
+		CompressMinSize:    compressMinSize,
+
+		CacheRanges: cacheRanges,
+
+		RefetchOnServeError: refetchOnServeError,
+
+		CachePools: cachePools,
+
+		AdminToken: adminToken,
+
+		StaleWhileRevalidate: staleWhileRevalidate,
+		StaleIfError:         staleIfError,
+
+		RewriteBody: rewriteBody,
+
+		ProxyProtocol: proxyProtocol,
+
+		UpstreamGzip: upstreamGzip,
+
+		MaxCachedHeaders: maxCachedHeaders,
+		TruncateHeaders:  truncateHeaders,
+
+		NodeID: nodeID,
+
+		HitWindow: hitWindow,
+
+		VerifyChecksum: verifyChecksum,
+
+		VaryDevice:    varyDevice,
+		DeviceClasses: deviceClasses,
+
+		RefreshWorkers: refreshWorkers,
+
+		VaryCookies: varyCookies,
+
+		BypassAuthorized: bypassAuthorized,
+
+		StatusTTL: statusTTL,
+
+		AllowedMethods: allowedMethods,
+
+		TrailingSlash: trailingSlash,
+
+		OriginHeaders: originHeader,
+
+		ValidateFreshness: validateFreshness,
+
+		StripResponseHeaders: stripResponseHeaders,
+
+		Admission: admission,
+
+		KeyOnVary: keyOnVary,
+
+		PrefetchFullOnRange: prefetchFullOnRange,
+
+		IndexContentLocation: indexContentLocation,
+
+		MaxVariants: maxVariants,
+
+		FallbackOrigins: fallbackOrigin,
+
+		ServerTiming: serverTiming,
+
+		CacheRoutes: cacheRoute,
+
+		NoCacheBody: noCacheBody,
+
+		Synthetic: synthetic,
+
+		EvictionGrace:         evictionGrace,
+		EvictionGraceMaxBytes: evictionGraceMaxBytes,
+
+		WarmupFile:    warmupFile,
+		WarmupTimeout: warmupTimeout,
+
+		CacheErrorsTTL: cacheErrorsTTL,
+
+		CoalesceHead: coalesceHead,
+
+		MinRevalidateInterval: minRevalidateInterval,
+
+		ExpectContinue: expectContinue,
+
+		RejectAmbiguousFraming: rejectAmbiguous,
+
+		ClientCacheControl: clientCacheControl,
+
+		KeyHeaders: keyHeaders,
+
+		Beacons: beacon,
+
+		UpstreamScheme: upstreamScheme,
+
+		BufferTimeout: bufferTimeout,
+
+		CacheSizeRange: cacheSizeRange,
+
+		LogFormat: logFormat,
+
+		RequestBudget: requestBudget,
+
+		JWTKey:       jwtKey,
+		JWTIssuer:    jwtIssuer,
+		JWTAudience:  jwtAudience,
+		ClaimHeaders: jwtClaimHeader,
+
+		ColdOrigin: coldOrigin,
+		HotOrigin:  hotOrigin,
+
+		CompressAtRest: compressAtRest,
+
+		RequestNoCache: requestNoCache,
+
+		CacheableStatus: cacheableStatus,
+
+		PersistFile: persistFile,
+
+		PublicURL: publicURL,
+	}
+}
+
+type options struct {
+	Target  *url.URL
+	Address string
+	Host    *string
+	Cache   *bool
+	TTL     *int
+	Log     *bool
+
+	WriteTimeout *time.Duration
+
+	Precompress        *string
+	PrecompressMaxSize *int
+	CompressMinSize    *int
+
+	CacheRanges *bool
+
+	RefetchOnServeError *bool
+
+	CachePools *string
+
+	AdminToken *string
+
+	StaleWhileRevalidate *time.Duration
+	StaleIfError         *time.Duration
+
+	RewriteBody *bodyRewrites
+
+	ProxyProtocol *bool
+
+	UpstreamGzip *bool
+
+	MaxCachedHeaders *int
+	TruncateHeaders  *bool
+
+	NodeID *string
+
+	HitWindow *time.Duration
+
+	VerifyChecksum *bool
+
+	VaryDevice    *bool
+	DeviceClasses *string
+
+	RefreshWorkers *int
+
+	VaryCookies *string
+
+	BypassAuthorized *bool
+
+	StatusTTL statusTTLs
+
+	AllowedMethods *string
+
+	TrailingSlash *string
+
+	OriginHeaders originHeaders
+
+	ValidateFreshness *bool
+
+	StripResponseHeaders *string
+
+	Admission *bool
+
+	KeyOnVary *bool
+
+	PrefetchFullOnRange *bool
+
+	IndexContentLocation *bool
+
+	MaxVariants *int
+
+	FallbackOrigins fallbackOrigins
+
+	ServerTiming *bool
+
+	CacheRoutes cacheRoutes
+
+	NoCacheBody *bodyFilters
+
+	Synthetic *syntheticResponses
+
+	EvictionGrace         *time.Duration
+	EvictionGraceMaxBytes *int
+
+	WarmupFile    *string
+	WarmupTimeout *time.Duration
+
+	CacheErrorsTTL *time.Duration
+
+	CoalesceHead *bool
+
+	MinRevalidateInterval *time.Duration
+
+	ExpectContinue *string
+
+	RejectAmbiguousFraming *bool
+
+	ClientCacheControl clientCacheControls
+
+	KeyHeaders *string
+
+	Beacons *beaconRoutes
+
+	UpstreamScheme *string
+
+	BufferTimeout *time.Duration
+
+	CacheSizeRange sizeRanges
+
+	LogFormat *string
+
+	RequestBudget *time.Duration
+
+	// nil lets everyone through unless -jwt-key is set
+	Auth AuthFunc
+
+	JWTKey       *string
+	JWTIssuer    *string
+	JWTAudience  *string
+	ClaimHeaders claimHeaders
+
+	ColdOrigin *originURL
+	HotOrigin  *originURL
+
+	CompressAtRest *bool
+
+	RequestNoCache *bool
+
+	CacheableStatus cacheableStatuses
+
+	PersistFile *string
+
+	PublicURL *originURL
+}
+
+func ensureHost(out *http.Request, o *options) {
+	if *o.Host != "" {
+		out.Host = *o.Host
+	}
+}
+
+// what goes to the origin follows the target's scheme, or
+// -upstream-scheme, never whatever the client used. TLS
+// ending here for a plaintext origin, or the other way
+// round, would otherwise dial the origin wrongly
+func ensureScheme(out *http.Request, o *options) {
+	scheme := *o.UpstreamScheme
+	if scheme == "" && o.Target != nil {
+		scheme = o.Target.Scheme
+	}
+
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	out.URL.Scheme = strings.ToLower(scheme)
+	if o.Target != nil && o.Target.Host != "" {
+		out.URL.Host = o.Target.Host
+	}
+}
+
+func validUpstreamScheme(scheme string) error {
+	switch strings.ToLower(scheme) {
+	case "", "http", "https":
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("invalid -upstream-scheme %q, must be http or https", scheme))
+}
+
+func maybeLog(o *options, out *http.Request) {
+	if *o.Log == true {
+		log.Println(fmt.Sprintf("%s %s", out.Method, out.URL))
+	}
+}
+
+// remembers whether the status line has gone out, after
+// which the only option left on failure is to abort
+type trackingWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (tw *trackingWriter) WriteHeader(code int) {
+	tw.wroteHeader = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+// a wedged client would otherwise hold the serving
+// goroutine forever, so when a write timeout is set the
+// write is cut short and whatever was sent is logged.
+// returns false if nothing was written and the caller
+// should go to the origin instead
+func serveCached(o *options, rw http.ResponseWriter, in *http.Request, cr *CachedResponse) bool {
+	switch {
+	case cr.atRest && acceptsGzip(in):
+		cr = cr.gzipped()
+	case cr.atRest:
+		cr = cr.inflated()
+	case cr.Gzip != nil && len(cr.Body) >= *o.CompressMinSize && acceptsGzip(in):
+		// below the minimum gzip's overhead outweighs the saving
+		cr = cr.gzipped()
+	}
+
+	if *o.WriteTimeout > 0 {
+		// not every ResponseWriter can reach its conn, in
+		// which case this is a no-op
+		rc := http.NewResponseController(rw)
+		rc.SetWriteDeadline(time.Now().Add(*o.WriteTimeout))
+	}
+
+	// HTTP/1.0 connections close unless asked not to
+	if in.ProtoMajor == 1 && in.ProtoMinor == 0 && !strings.EqualFold(in.Header.Get("Connection"), "keep-alive") {
+		rw.Header().Set("Connection", "close")
+	}
+
+	tw := &trackingWriter{ResponseWriter: rw}
+	n, err := io.Copy(tw, cr)
+	if err == nil {
+		return true
+	}
+
+	if !tw.wroteHeader {
+		log.Println(fmt.Sprintf("failed to serve cached response: %s", err))
+		if *o.RefetchOnServeError {
+			return false
+		}
+
+		rw.WriteHeader(http.StatusBadGateway)
+		return true
+	}
+
+	// the client has a status and maybe part of the body,
+	// so drop the connection rather than let it look whole
+	log.Println(fmt.Sprintf("truncated cached response after %d of %d bytes: %s", n, len(cr.Body), err))
+	panic(http.ErrAbortHandler)
+}
+
+func newCache(o *options) *Cache {
+	pools, err := parsePools(*o.CachePools)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cache := &Cache{
+		cache:    make(map[string]*CachedResponse),
+		segments: make(map[string]*SegmentedResponse),
+		variants: make(map[string]map[string]bool),
+		pools:    pools,
+		stats:    &cacheStats{window: newHitWindow(*o.HitWindow)},
+
+		refresher: newRefresher(*o.RefreshWorkers),
+
+		maxVariants: *o.MaxVariants,
+	}
+
+	if *o.VaryDevice {
+		cache.devices, err = parseDeviceClasses(*o.DeviceClasses)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, name := range strings.Split(*o.VaryCookies, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			cache.cookies = append(cache.cookies, name)
+		}
+	}
+
+	for _, name := range headerList(*o.KeyHeaders) {
+		cache.headers = append(cache.headers, strings.ToLower(name))
+	}
+
+	// what the origin is told about the client can change
+	// what it answers, one user's page mustn't go to another
+	for _, name := range o.ClaimHeaders.headers() {
+		cache.headers = append(cache.headers, strings.ToLower(name))
+	}
+
+	if *o.KeyOnVary {
+		cache.vary = make(map[string][]string)
+		cache.covered = make(map[string]bool)
+
+		for _, name := range cache.headers {
+			cache.covered[name] = true
+		}
+
+		if cache.devices != nil {
+			cache.covered["user-agent"] = true
+		}
+
+		if len(o.ClaimHeaders) > 0 {
+			cache.covered["authorization"] = true
+		}
+	}
+
+	if *o.EvictionGrace > 0 {
+		cache.graveyard = newGraveyard(*o.EvictionGrace, *o.EvictionGraceMaxBytes)
+	}
+
+	if *o.Admission {
+		cache.sketch = newFrequencySketch(admissionSketchWidth)
+	}
+
+	if *o.PersistFile != "" {
+		if err := cache.load(*o.PersistFile, time.Now()); err != nil {
+			log.Println(fmt.Sprintf("failed to restore cache from %s: %s", *o.PersistFile, err))
+		}
+	}
+
+	return cache
+}
+
+func cacheHandle(o *options, cache *Cache) func(*rox.Rox, http.ResponseWriter, *http.Request, *http.Request) {
+	return func(p *rox.Rox, rw http.ResponseWriter, in *http.Request, out *http.Request) {
+		ensureHost(out, o)
+		ensureScheme(out, o)
+		expectContinue(o, out)
+		rox.PrepareRequest(out)
+		o.OriginHeaders.apply(out)
+
+		authorized := *o.BypassAuthorized && out.Header.Get("Authorization") != ""
+
+		if *o.CacheRanges && out.Method == "GET" && !authorized {
+			if r, ok := parseRange(out.Header.Get("Range")); ok {
+				serveRange(o, cache, p, rw, out, r)
+				return
+			}
+		}
+
+		if !isSafe(out.Method) {
+			serveMutation(o, cache, p, rw, out)
+			return
+		}
+
+		if *o.UpstreamGzip {
+			out.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		if authorized {
+			serveAuthorized(o, cache, p, rw, in, out)
+			return
+		}
+
+		var stale *CachedResponse
+		now := time.Now()
+		fresh := minFresh(out)
+		reload := *o.RequestNoCache && requestNoCache(out)
+
+		cr := cache.Get(out)
+		lookup := time.Since(now)
+
+		if cr == nil && out.Method == "HEAD" && *o.CoalesceHead && !reload {
+			// a GET already held or on its way has everything
+			// a HEAD needs, the server drops the body itself
+			get := out.Clone(out.Context())
+			get.Method = "GET"
+
+			if g := cache.Get(get); g != nil && g.Fresh(time.Now().Add(fresh)) && serveCached(o, rw, in, g) {
+				cache.stats.hit(0)
+				noteCacheStatus(in, "hit")
+				maybeLog(o, out)
+				return
+			}
+		}
+
+		if cr != nil {
+			switch {
+			case !reload && cr.Fresh(now.Add(fresh)):
+				if *o.ServerTiming {
+					setServerTiming(rw, "hit", lookup, 0)
+				}
+
+				if serveCached(o, rw, in, cr) {
+					cache.stats.hit(cr.bodyLength())
+					noteCacheStatus(in, "hit")
+					maybeLog(o, out)
+
+					if *o.ValidateFreshness {
+						startValidation(o, cache, p, out, cr)
+					}
+					return
+				}
+			case !reload && fresh == 0 && !cr.negative && !cr.noCache && cr.Staleness(now) <= staleWindow(*o.StaleWhileRevalidate, cr.StaleWhileRevalidate):
+				startRefresh(o, cache, p, out, cr)
+
+				if *o.ServerTiming {
+					setServerTiming(rw, "stale", lookup, 0)
+				}
+
+				window := staleWindow(*o.StaleWhileRevalidate, cr.StaleWhileRevalidate)
+				if serveCached(o, rw, in, cr.stale(now, warnStale, window)) {
+					cache.stats.hit(cr.bodyLength())
+					noteCacheStatus(in, "stale")
+					maybeLog(o, out)
+					return
+				}
+			case !cr.negative:
+				stale = cr
+			}
+		}
+
+		// gave up waiting on someone else's fill, which is
+		// left alone for those still waiting
+		if out.Context().Err() != nil {
+			return
+		}
+
+		// lets a wedged fill be cancelled from the admin api
+		ctx, cancel := context.WithCancel(out.Context())
+		defer cancel()
+		out = out.WithContext(ctx)
+
+		cr = cache.Create(out, cancel)
+		defer cr.completeUpdate()
+		cache.stats.miss()
+		noteCacheStatus(in, "miss")
+
+		revalidating := stale != nil && conditional(out, stale)
+
+		budget := startBudget(o, now, cancel)
+
+		fetched := time.Now()
+		res, err := rox.DoRequest(p, tieredRequest(o, out, revalidating))
+		maybeLog(o, out)
+
+		if err == nil && res.StatusCode == http.StatusNotFound {
+			res = tryFallback(o, p, out, res)
+		}
+		budget.stop()
+
+		if *o.ServerTiming {
+			setServerTiming(rw, "miss", lookup, time.Since(fetched))
+		}
+
+		if res != nil {
+			defer res.Body.Close()
+			withBufferTimeout(o, res, fetched)
+		}
+
+		// whatever we have beats keeping the client waiting
+		if err != nil && budget.exceeded() {
+			if stale != nil && !stale.noCache {
+				cache.Replace(out, cr, stale)
+				noteCacheStatus(in, "stale")
+				serveCached(o, rw, in, stale.stale(now, warnRevalidateFailed, 0))
+				return
+			}
+
+			cache.Remove(out, cr)
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+
+		if (err != nil || res.StatusCode >= 500) && stale != nil && !stale.noCache &&
+			stale.Staleness(now) <= staleWindow(*o.StaleIfError, stale.StaleIfError) {
+			// put back what we had so others can use it too
+			cache.Replace(out, cr, stale)
+			noteCacheStatus(in, "stale")
+			serveCached(o, rw, in, stale.stale(now, warnRevalidateFailed, 0))
+			return
+		}
+
+		if err != nil {
+			cache.Remove(out, cr)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if revalidating && res.StatusCode == http.StatusNotModified {
+			noteCacheStatus(in, "revalidated")
+			revalidate(o, cr, stale, res)
+			cache.Account(out, cr)
+		} else if fill(o, out, cr, res) {
+			cache.Account(out, cr)
+
+			if *o.IndexContentLocation {
+				indexContentLocation(cache, out, cr)
+			}
+		} else if bufferExpired(res) {
+			cache.Remove(out, cr)
+			cr.completeUpdate()
+			streamPartial(rw, out, cr, res)
+			return
+		} else {
+			// still served from the buffered copy below
+			cache.Remove(out, cr)
+		}
+		cr.completeUpdate()
+
+		if !serveCached(o, rw, in, cr) {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	}
+}
+
+// buffers res into cr and reports whether it may be kept
+func fill(o *options, out *http.Request, cr *CachedResponse, res *http.Response) bool {
+	cr.Set(res, o.StatusTTL.ttl(res.StatusCode, *o.TTL))
+	if bufferExpired(res) {
+		return false
+	}
+
+	if out.Method == "OPTIONS" {
+		preflightTTL(cr)
+	}
+	throttleRevalidation(o, cr)
+
+	// an error is only held long enough to spare a failing
+	// origin the full weight of traffic, then retried
+	if *o.CacheErrorsTTL > 0 && cr.StatusCode >= 500 {
+		cr.Expires = cr.Stored.Add(*o.CacheErrorsTTL)
+		cr.negative = true
+	}
+
+	// not worth holding on to what will never be sent
+	for _, name := range headerList(*o.StripResponseHeaders) {
+		cr.Header.Del(name)
+	}
+
+	// caches further down need to know the key headers
+	// make a difference as much as anything the origin says
+	for _, name := range headerList(*o.KeyHeaders) {
+		addVary(cr.Header, name)
+	}
+
+	// the device class is worked out from User-Agent, so
+	// that's what caches further down have to key on
+	if *o.VaryDevice {
+		addVary(cr.Header, "User-Agent")
+	}
+
+	// as with -key-headers, and Authorization as that's all
+	// caches further down can tell users apart by
+	if len(o.ClaimHeaders) > 0 {
+		for _, name := range o.ClaimHeaders.headers() {
+			addVary(cr.Header, name)
+		}
+		addVary(cr.Header, "Authorization")
+	}
+
+	if *o.KeyOnVary {
+		normalizeVary(cr.Header)
+	}
+
+	if *o.UpstreamGzip {
+		if err := decodeUpstreamGzip(cr); err != nil {
+			log.Println(fmt.Sprintf("failed to decode gzip from origin: %s", err))
+			return false
+		}
+	}
+
+	// a gzip variant from the origin no longer matches
+	if transformBody(o, cr) && cr.Gzip != nil {
+		cr.Precompress()
+	}
+
+	// part of a body can't stand in for the whole of it,
+	// ranges are only kept as segments by serveRange
+	if cr.StatusCode == http.StatusPartialContent || !storable(o, out, cr, res) {
+		return false
+	}
+
+	if shouldPrecompress(o, cr) {
+		cr.Precompress()
+	}
+
+	if *o.VerifyChecksum {
+		cr.checksum = crc32.ChecksumIEEE(cr.Body)
+		cr.gzipChecksum = crc32.ChecksumIEEE(cr.Gzip)
+		cr.hasChecksum = true
+	}
+
+	if *o.CompressAtRest && cr.Gzip != nil {
+		cr.restCompressed()
+	}
+
+	return true
+}
+
+// what any response has to pass to be kept, whole or as a
+// range segment. cr has been read in from res
+func storable(o *options, out *http.Request, cr *CachedResponse, res *http.Response) bool {
+	if cr.overran {
+		log.Println(fmt.Sprintf("%s sent more than its Content-Length, not caching", out.URL))
+		return false
+	}
+
+	if cr.underran {
+		log.Println(fmt.Sprintf("%s didn't send all of its body, not caching", out.URL))
+		return false
+	}
+
+	if !isCacheable(res) || !statusCacheable(o, res) || !varyCookieSafe(o, cr) || !limitHeaders(o, out, cr) {
+		return false
+	}
+
+	if !o.CacheSizeRange.allows(out.URL.Path, len(cr.Body)) {
+		return false
+	}
+
+	return !o.NoCacheBody.rejects(cr)
+}
+
+// authenticated content is per user so it always comes
+// from the origin, and is only kept if the origin says it
+// is public anyway
+func serveAuthorized(o *options, cache *Cache, p *rox.Rox, rw http.ResponseWriter, in *http.Request, out *http.Request) {
+	cache.stats.miss()
+
+	res, err := rox.DoRequest(p, tieredRequest(o, out, false))
+	maybeLog(o, out)
+
+	if res != nil {
+		defer res.Body.Close()
 	}
 
-	addresses := strings.Split(*address, ",")
-	al := len(addresses)
-	i := 0
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	for _, add := range addresses {
-		opts := &options{
-			Target:  target,
-			Address: add,
-			Host:    host,
-			Cache:   cache,
-			TTL:     ttl,
-			Log:     log,
+	cr := &CachedResponse{}
+	if fill(o, out, cr, res) {
+		if _, public := responseCacheControl(res)["public"]; public {
+			cache.Put(out, cr)
 		}
+	}
 
-		i += 1
-		if i == al {
-			createProxy(opts)
-		} else {
-			go createProxy(opts)
-		}
+	if !serveCached(o, rw, in, cr) {
+		rw.WriteHeader(http.StatusBadGateway)
 	}
 }
 
-type options struct {
-	Target  *url.URL
-	Address string
-	Host    *string
-	Cache   *bool
-	TTL     *int
-	Log     *bool
+func writeResponse(rw http.ResponseWriter, res *http.Response) {
+	rox.CopyHeader(rw.Header(), res.Header)
+	rw.WriteHeader(res.StatusCode)
+	io.Copy(rw, res.Body)
 }
 
-func ensureHost(out *http.Request, o *options) {
-	if *o.Host != "" {
-		out.Host = *o.Host
+func isSafe(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
 	}
+
+	return false
 }
 
-func maybeLog(o *options, out *http.Request) {
-	if *o.Log == true {
-		log.Println(fmt.Sprintf("%s %s", out.Method, out.URL))
+// writes go straight through, preconditions and all, but
+// once one succeeds whatever we hold for that URL (and
+// anything it says it moved to) is out of date
+func serveMutation(o *options, cache *Cache, p *rox.Rox, rw http.ResponseWriter, out *http.Request) {
+	res, err := rox.DoRequest(p, out)
+	maybeLog(o, out)
+
+	if res != nil {
+		defer res.Body.Close()
 	}
-}
 
-func cacheHandle(o *options) func(*rox.Rox, http.ResponseWriter, *http.Request, *http.Request) {
-	cache := &Cache{
-		cache: make(map[string]*CachedResponse),
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	return func(p *rox.Rox, rw http.ResponseWriter, in *http.Request, out *http.Request) {
-		ensureHost(out, o)
-		rox.PrepareRequest(out)
+	if res.StatusCode >= 200 && res.StatusCode < 400 {
+		cache.Invalidate(out.URL)
 
-		cr := cache.Get(out)
-		if cr != nil {
-			io.Copy(rw, cr)
-			maybeLog(o, out)
-			return
+		for _, h := range []string{"Location", "Content-Location"} {
+			if u := sameOriginRef(out.URL, res.Header.Get(h)); u != nil {
+				cache.Invalidate(u)
+			}
 		}
+	}
 
-		cr = cache.Create(out)
+	writeResponse(rw, res)
+}
 
-		res, err := rox.DoRequest(p, out)
-		maybeLog(o, out)
+// only references back to the same host may be
+// invalidated, otherwise one origin could purge another's
+// entries
+func sameOriginRef(base *url.URL, ref string) *url.URL {
+	if ref == "" {
+		return nil
+	}
 
-		if res != nil {
-			defer res.Body.Close()
-		}
+	u, err := base.Parse(ref)
+	if err != nil || u.Scheme != base.Scheme || u.Host != base.Host {
+		return nil
+	}
 
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	return u
+}
 
-		cr.Set(res, *o.TTL)
-		// pull out
-		select {
-		case <-cr.UpdateChan:
-			cr.UpdateChan = nil
-		default:
-			cr.UpdateChan = nil
-		}
-		io.Copy(rw, cr)
+// a response naming where it canonically lives can also
+// answer requests made there directly
+func indexContentLocation(cache *Cache, out *http.Request, cr *CachedResponse) {
+	if out.Method != "GET" {
+		return
+	}
+
+	u := sameOriginRef(out.URL, cr.Header.Get("Content-Location"))
+	if u == nil || urlKey("GET", u) == urlKey("GET", out.URL) {
+		return
 	}
+
+	alias := out.Clone(out.Context())
+	alias.URL = u
+	cache.Alias(alias, cr, time.Now())
 }
 
 func regularRequest(o *options) func(*rox.Rox, http.ResponseWriter, *http.Request, *http.Request) {
 	return func(p *rox.Rox, rw http.ResponseWriter, in *http.Request, out *http.Request) {
 		ensureHost(out, o)
+		ensureScheme(out, o)
+		expectContinue(o, out)
+		o.OriginHeaders.apply(out)
 		rox.DefaultMakeRequest(p, rw, in, out)
 		maybeLog(o, out)
 	}
 }
 
-func createMakeRequest(o *options) func(*rox.Rox, http.ResponseWriter, *http.Request, *http.Request) {
-	if *o.Cache == true {
-		return cacheHandle(o)
+func createMakeRequest(o *options, cache *Cache) func(*rox.Rox, http.ResponseWriter, *http.Request, *http.Request) {
+	if cache == nil {
+		return regularRequest(o)
+	}
+
+	if len(o.CacheRoutes) == 0 {
+		return cacheHandle(o, cache)
 	}
 
-	return regularRequest(o)
+	cached := cacheHandle(o, cache)
+	live := regularRequest(o)
+
+	return func(p *rox.Rox, rw http.ResponseWriter, in *http.Request, out *http.Request) {
+		if o.CacheRoutes.caches(out.URL.Path, *o.Cache) {
+			cached(p, rw, in, out)
+		} else {
+			live(p, rw, in, out)
+		}
+	}
 }
 
 func createProxy(o *options) {
-	makeRequest := createMakeRequest(o)
+	handler, cache := newProxyHandler(o)
+	ln := listen(o)
+
+	log.Println(fmt.Sprintf("starting proxy server at address %s", o.Address))
+
+	if cache == nil || *o.PersistFile == "" {
+		log.Fatal(http.Serve(ln, handler))
+	}
+
+	srv := &http.Server{Handler: handler}
+	done := make(chan struct{})
+	go func() {
+		persistOnShutdown(srv, cache, *o.PersistFile)
+		close(done)
+	}()
+
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-done
+}
+
+func listen(o *options) net.Listener {
+	address := o.Address
+	if address == "" {
+		address = ":http"
+	}
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *o.ProxyProtocol {
+		ln = &proxyProtoListener{ln}
+	}
+
+	if *o.RejectAmbiguousFraming {
+		ln = &framingListener{ln}
+	}
+
+	return ln
+}
+
+// everything a client's request passes through, and the
+// cache behind it if there is one
+func newProxyHandler(o *options) (http.Handler, *Cache) {
+	if err := validExpectContinue(*o.ExpectContinue); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validUpstreamScheme(*o.UpstreamScheme); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validLogFormat(*o.LogFormat); err != nil {
+		log.Fatal(err)
+	}
+
+	var cache *Cache
+	if *o.Cache == true || o.CacheRoutes.any() {
+		cache = newCache(o)
+	}
+
+	makeRequest := createMakeRequest(o, cache)
 
 	proxy := &rox.Rox{
 		MakeRequest: makeRequest,
 		Target:      o.Target,
 	}
 
-	log.Println(fmt.Sprintf("starting proxy server at address %s", o.Address))
-	log.Fatal(http.ListenAndServe(o.Address, proxy))
+	var err error
+	var forward http.Handler = proxy
+	if len(o.ClientCacheControl) > 0 {
+		forward = rewriteClientCacheControl(o.ClientCacheControl, forward)
+	}
+
+	if o.PublicURL.URL != nil {
+		forward = rewriteOriginURLs(o, forward)
+	}
+
+	if *o.StripResponseHeaders != "" {
+		forward = stripResponseHeaders(headerList(*o.StripResponseHeaders), forward)
+	}
+
+	if *o.TrailingSlash != "" {
+		forward, err = canonicalSlash(*o.TrailingSlash, forward)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(*o.Synthetic) > 0 {
+		forward = serveSynthetic(*o.Synthetic, forward)
+	}
+
+	if len(*o.Beacons) > 0 {
+		forward = serveBeacons(o, forward)
+	}
+
+	if *o.AllowedMethods != "" {
+		forward = allowMethods(*o.AllowedMethods, forward)
+	}
+
+	if o.Auth == nil && *o.JWTKey != "" {
+		if o.Auth, err = newJWTAuth(o); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if o.Auth != nil {
+		forward = authenticate(o, forward)
+	}
+
+	handler := newAdminServer(o, cache, forward)
+	if *o.WarmupFile != "" {
+		handler = startWarmup(o, forward).handler(handler)
+	}
+
+	if *o.RejectAmbiguousFraming {
+		handler = rejectAmbiguousFraming(handler)
+	}
+
+	if *o.NodeID != "" {
+		handler = servedBy(*o.NodeID, handler)
+	}
+
+	if *o.LogFormat != "" {
+		handler = accessLog(*o.LogFormat, os.Stdout, handler)
+	}
+
+	return handler, cache
 }
 
+// only written while pending, once complete it stays as it
+// is. a refresh or revalidation builds a new one and swaps
+// it in, Body included, so anyone partway through serving
+// the old one carries on with what they started with
 type CachedResponse struct {
 	lk         sync.Mutex
 	Header     http.Header
 	StatusCode int
 	Body       []byte
 	UpdateChan chan error
+
+	// optional gzip encoded copy of Body, compressed is set
+	// if it was made here rather than by the origin
+	Gzip       []byte
+	compressed bool
+
+	// only Gzip is held, Body is nil and length is how long
+	// it would be
+	atRest bool
+	length int
+
+	// a zero Expires never goes stale
+	Stored  time.Time
+	Expires time.Time
+
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	refreshing atomic.Bool
+	validated  atomic.Bool
+	updated    bool
+	overran    bool
+	underran   bool
+
+	// a briefly cached 5xx that must never be served stale
+	negative bool
+
+	// Cache-Control: no-cache, only fresh for as long as
+	// -min-revalidate-interval allows
+	noCache bool
+
+	// set for placeholders while their fill is in flight
+	pendingSince time.Time
+	cancel       context.CancelFunc
+
+	hasChecksum  bool
+	checksum     uint32
+	gzipChecksum uint32
 }
 
 func (cr *CachedResponse) Write(p []byte) (int, error) {
@@ -187,27 +1272,36 @@ func (cr *CachedResponse) Read(p []byte) (int, error) {
 	return 0, errors.New("Cached Request Body is nil")
 }
 
+// writes straight from the stored body, which is never
+// changed in place once filled, so a large entry doesn't
+// cost a second copy of itself for every client
 func (cr *CachedResponse) WriteTo(w io.Writer) (int64, error) {
-	b := make([]byte, len(cr.Body))
-	_, er := cr.Read(b)
+	b := cr.Body
+	if b == nil {
+		return 0, errors.New("Cached Request Body is nil")
+	}
 
-	if er != nil {
-		return 0, er
+	if cr.hasChecksum && crc32.ChecksumIEEE(b) != cr.checksum {
+		return 0, errors.New("Cached Response Body failed checksum")
 	}
 
 	if hrw, ok := w.(http.ResponseWriter); ok {
 		rox.CopyHeader(hrw.Header(), cr.Header)
+
+		// the whole body is known so there is never a need
+		// to fall back to chunked encoding. HEAD entries keep
+		// the length the origin gave, if it gave one, and
+		// net/http settles an empty body itself
+		if hrw.Header().Get("Content-Length") == "" && len(b) > 0 {
+			hrw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		}
+
 		hrw.WriteHeader(cr.StatusCode)
 		w = hrw
 	}
 
 	nw, err := w.Write(b)
-
-	if err != nil {
-		return 0, err
-	}
-
-	return int64(nw), nil
+	return int64(nw), err
 }
 
 func (cr *CachedResponse) Close() error {
@@ -219,70 +1313,361 @@ func (cr *CachedResponse) Set(res *http.Response, TTL int) {
 	rox.CopyHeader(header, res.Header)
 	cr.Header = header
 	cr.StatusCode = res.StatusCode
-	io.Copy(cr, res.Body)
 
-	defer func() {
-		go cr.completeUpdate()
-	}()
+	// never read past the declared length, bytes beyond it
+	// belong to nothing we asked for. one extra is enough
+	// to tell that the origin overran
+	cl, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil || cl < 0 {
+		cl = -1
+		_, err = io.Copy(cr, res.Body)
+	} else {
+		_, err = io.Copy(cr, io.LimitReader(res.Body, cl+1))
+		if int64(len(cr.Body)) > cl {
+			cr.Body = cr.Body[:cl]
+			cr.overran = true
+		}
+	}
+
+	// what did arrive is still passed on, but a body the
+	// origin cut short mustn't be kept as if it were whole
+	if err != nil || int64(len(cr.Body)) < cl {
+		cr.underran = true
+	}
+
+	cr.expire(responseCacheControl(res), TTL)
+
+	// an empty body is still a valid cached body, nil is
+	// reserved for one that couldn't be read
+	if cr.Body == nil {
+		cr.Body = []byte{}
+	}
+}
+
+func (cr *CachedResponse) expire(cc map[string]string, TTL int) {
+	// as a shared cache s-maxage is ours, max-age is left
+	// in the header for clients but is the next best thing
+	cr.Stored = time.Now()
+	cr.Expires = time.Time{}
+	if ttl, ok := directiveSeconds(cc, "s-maxage"); ok {
+		cr.Expires = cr.Stored.Add(ttl)
+	} else if ttl, ok := directiveSeconds(cc, "max-age"); ok {
+		cr.Expires = cr.Stored.Add(ttl)
+	} else if TTL >= 0 {
+		cr.Expires = cr.Stored.Add(time.Duration(TTL) * time.Second)
+	}
+
+	cr.StaleWhileRevalidate, _ = directiveSeconds(cc, "stale-while-revalidate")
+	cr.StaleIfError, _ = directiveSeconds(cc, "stale-if-error")
+
+	// may be stored but has to be checked with the origin
+	// every time it's used. no-cache="field" only covers
+	// those fields, which are sent on as they are
+	if v, ok := cc["no-cache"]; ok && v == "" {
+		cr.noCache = true
+		cr.Expires = cr.Stored
+	}
+}
+
+// store a gzip variant next to the identity body so
+// the first gzip capable client doesn't pay for it
+func (cr *CachedResponse) Precompress() {
+	gz, err := gzipBytes(cr.Body)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to precompress response: %s", err))
+		return
+	}
+
+	addVary(cr.Header, "Accept-Encoding")
+	cr.Gzip = gz
+	cr.compressed = true
+}
+
+func (cr *CachedResponse) Fresh(now time.Time) bool {
+	return cr.Expires.IsZero() || now.Before(cr.Expires)
+}
+
+func (cr *CachedResponse) Staleness(now time.Time) time.Duration {
+	if cr.Fresh(now) {
+		return 0
+	}
+
+	return now.Sub(cr.Expires)
+}
+
+func (cr *CachedResponse) size() int {
+	return len(cr.Body) + len(cr.Gzip)
+}
+
+func (cr *CachedResponse) gzipped() *CachedResponse {
+	header := make(http.Header)
+	rox.CopyHeader(header, cr.Header)
+	header.Set("Content-Encoding", "gzip")
+	header.Set("Content-Length", strconv.Itoa(len(cr.Gzip)))
+	if cr.compressed {
+		markTransformed(header)
+	}
+
+	return &CachedResponse{
+		Header:     header,
+		StatusCode: cr.StatusCode,
+		Body:       cr.Gzip,
+
+		hasChecksum: cr.hasChecksum,
+		checksum:    cr.gzipChecksum,
+	}
 }
 
+func (cr *CachedResponse) pending() bool {
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+
+	return cr.UpdateChan != nil && !cr.updated
+}
+
+// closing rather than sending releases any number of
+// waiters, including none, without a goroutine left
+// blocked on the send. safe to call more than once
 func (cr *CachedResponse) completeUpdate() {
-	if cr.UpdateChan != nil {
-		cr.UpdateChan <- nil
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+
+	if cr.UpdateChan != nil && !cr.updated {
+		close(cr.UpdateChan)
+		cr.updated = true
 	}
 }
 
 type Cache struct {
-	lk    sync.Mutex
-	cache map[string]*CachedResponse
+	lk       sync.Mutex
+	cache    map[string]*CachedResponse
+	segments map[string]*SegmentedResponse
+	pools    []*cachePool
+	stats    *cacheStats
+	devices  []deviceRule
+	cookies  []string
+	headers  []string
+	vary     map[string][]string
+
+	// request headers the base key already accounts for
+	covered map[string]bool
+
+	// every key held for each URL, across all its variants
+	variants map[string]map[string]bool
+
+	maxVariants int
+
+	graveyard *graveyard
+
+	refresher *refresher
+	sketch    *frequencySketch
 }
 
 func getKey(r *http.Request) string {
+	return urlKey(r.Method, r.URL)
+}
+
+// separates a URL's key from the variant of it being
+// stored, so every variant of a URL can be found
+const variantSep = "\x00"
+
+// the key entries are actually stored under, a URL can
+// have a number of variants computed from the request.
+// must be called with the cache lock held
+func (c *Cache) key(req *http.Request) string {
+	key := c.baseKey(req)
+	if fields := c.vary[key]; fields != nil {
+		key += variantSep + varyKey(fields, req)
+	}
+
+	return key
+}
+
+// everything but what the origin has told us it varies on
+func (c *Cache) baseKey(req *http.Request) string {
+	var variant []string
+	if c.devices != nil {
+		variant = append(variant, deviceClass(c.devices, req))
+	}
+
+	if c.cookies != nil {
+		variant = append(variant, cookieKey(c.cookies, req))
+	}
+
+	if c.headers != nil {
+		variant = append(variant, headerKey(c.headers, req))
+	}
+
+	if req.Method == "OPTIONS" {
+		variant = append(variant, preflightKey(req))
+	}
+
+	key := getKey(req)
+	if variant != nil {
+		key += variantSep + strings.Join(variant, variantSep)
+	}
+
+	return key
+}
+
+func urlKey(method string, u *url.URL) string {
+	// hand built requests may not carry a URL at all
+	if u == nil {
+		return method
+	}
+
 	var query string
 
-	if r.URL.RawQuery != "" {
-		q := []string{"?", r.URL.RawQuery}
+	if u.RawQuery != "" {
+		q := []string{"?", u.RawQuery}
 		query = strings.Join(q, "")
 	}
 
-	s := []string{r.Method, r.URL.Scheme, r.URL.Host, r.URL.Path, query}
+	// the escaped form, so /a%2Fb and /a/b stay distinct
+	s := []string{method, strings.ToLower(u.Scheme), keyHost(u), u.EscapedPath(), query}
 	return strings.Join(s, "")
 }
 
+// hosts are case insensitive and the default port is the
+// same as none, so neither should make a different key
+func keyHost(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return strings.TrimSuffix(host, ":443")
+	case "http", "":
+		return strings.TrimSuffix(host, ":80")
+	}
+
+	return host
+}
+
 func (c *Cache) Get(req *http.Request) *CachedResponse {
-	key := getKey(req)
+	c.lk.Lock()
+	if c.sketch != nil {
+		c.sketch.increment(c.key(req))
+	}
+	c.lk.Unlock()
 
-	var cached *CachedResponse
-
-	if c.cache[key] != nil {
-		// check ttl
-		cached = c.cache[key]
-
-		// if the update channel is
-		// available then we can block
-		// until this is ready to consume
-		if cached.UpdateChan != nil {
-		pendingUpdate:
-			for {
-				select {
-				case err := <-cached.UpdateChan:
-					if err != nil {
-						panic(err)
-					}
-				default:
-					break pendingUpdate
-				}
-			}
+	for {
+		// the fill waited on may have changed what the URL
+		// varies on, so the key is worked out each time
+		c.lk.Lock()
+		key := c.key(req)
+		cached := c.cache[key]
+		if cached != nil {
+			c.pool(req).touch(key)
+		} else if c.graveyard != nil {
+			cached = c.restore(req, key, time.Now())
+		}
+		c.lk.Unlock()
+
+		if cached == nil || !cached.pending() {
+			return cached
 		}
+
+		// someone else is already filling this entry, so
+		// wait for them rather than go to the origin too.
+		// once woken look again, a failed or uncacheable
+		// fill will have been taken out of the cache
+		select {
+		case <-cached.UpdateChan:
+		case <-req.Context().Done():
+			return nil
+		}
+	}
+}
+
+// drop anything that would be served for a read of u
+func (c *Cache) Invalidate(u *url.URL) {
+	c.InvalidateAll([]*url.URL{u})
+}
+
+func (c *Cache) Remove(req *http.Request, cr *CachedResponse) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	key := c.key(req)
+	if c.cache[key] == cr {
+		c.pool(req).remove(key)
+		delete(c.cache, key)
+		c.untrackVariant(key)
 	}
+}
 
-	return cached
+// stores an already filled response, replacing whatever
+// was held for req
+func (c *Cache) Put(req *http.Request, cr *CachedResponse) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.put(req, cr)
 }
 
-func (c *Cache) Create(req *http.Request) *CachedResponse {
+// holds cr under req's key as well, unless something
+// fresh or being filled is already there
+func (c *Cache) Alias(req *http.Request, cr *CachedResponse, now time.Time) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if old := c.cache[c.key(req)]; old != nil && (old.pending() || old.Fresh(now)) {
+		return
+	}
+
+	c.put(req, cr)
+}
+
+// must be called with the cache lock held
+func (c *Cache) put(req *http.Request, cr *CachedResponse) {
+	key := c.key(req)
+	p := c.pool(req)
+	p.remove(key)
+	c.cache[key] = cr
+	p.add(key)
+	c.trackVariant(key)
+	key = c.rekey(req, key, cr)
+	c.limitVariants(req, key)
+	p.resize(key, cr.size())
+	c.evict(p, key)
+}
+
+func (c *Cache) Create(req *http.Request, cancel context.CancelFunc) *CachedResponse {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.create(req, cancel)
+}
+
+// like Create, but leaves alone anything fresh or already
+// being filled for req and returns nil instead
+func (c *Cache) CreateMissing(req *http.Request, cancel context.CancelFunc, now time.Time) *CachedResponse {
 	c.lk.Lock()
-	key := getKey(req)
-	c.cache[key] = &CachedResponse{UpdateChan: make(chan error)}
 	defer c.lk.Unlock()
-	return c.cache[key]
+
+	if cr := c.cache[c.key(req)]; cr != nil && (cr.pending() || cr.Fresh(now)) {
+		return nil
+	}
+
+	return c.create(req, cancel)
+}
+
+// must be called with the cache lock held
+func (c *Cache) create(req *http.Request, cancel context.CancelFunc) *CachedResponse {
+	key := c.key(req)
+	p := c.pool(req)
+	p.remove(key)
+	c.graveyard.remove(key)
+	cr := &CachedResponse{
+		UpdateChan:   make(chan error),
+		pendingSince: time.Now(),
+		cancel:       cancel,
+	}
+	c.cache[key] = cr
+	p.add(key)
+	c.trackVariant(key)
+	// admission may turn it away straight off, it is still
+	// filled and served just not kept
+	c.evict(p, key)
+	return cr
 }
@@ -0,0 +1,1206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// options as main would build them from args, with the
+// proxy on a free loopback port
+func testOptions(t *testing.T, target string, args ...string) *options {
+	t.Helper()
+
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	o := defineFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if target != "" {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o.Target = u
+	}
+
+	o.Address = "127.0.0.1:0"
+	return o
+}
+
+// serves o until the test ends, returning its base URL
+func startProxy(t *testing.T, o *options) (string, *Cache) {
+	t.Helper()
+
+	handler, cache := newProxyHandler(o)
+	ln := listen(o)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return "http://" + ln.Addr().String(), cache
+}
+
+func newProxy(t *testing.T, target string, args ...string) (string, *Cache) {
+	t.Helper()
+	return startProxy(t, testOptions(t, target, args...))
+}
+
+type testOrigin struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+// counts what reaches it so a test can tell hits from
+// misses
+func newOrigin(t *testing.T, handler http.HandlerFunc) *testOrigin {
+	t.Helper()
+
+	origin := &testOrigin{}
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		origin.requests.Add(1)
+		handler(rw, r)
+	}))
+	t.Cleanup(origin.Close)
+
+	return origin
+}
+
+// redirects come back as they are, Accept-Encoding is
+// only sent if a test asks for it and no connections are
+// left open for the goroutine checks to trip over
+var testTransport = &http.Transport{DisableCompression: true, DisableKeepAlives: true}
+
+// header is name, value pairs
+func request(t *testing.T, method string, u string, header ...string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i+1 < len(header); i += 2 {
+		if strings.EqualFold(header[i], "Host") {
+			req.Host = header[i+1]
+			continue
+		}
+
+		req.Header.Add(header[i], header[i+1])
+	}
+
+	res, err := testTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, string(body)
+}
+
+func get(t *testing.T, u string, header ...string) (*http.Response, string) {
+	t.Helper()
+	return request(t, "GET", u, header...)
+}
+
+// writes raw to the proxy and reads back one response
+func rawRequest(t *testing.T, base string, raw string) *http.Response {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+// how many goroutines are somewhere in fn. the name is
+// looked up rather than written out as under test main is
+// known by its import path
+func goroutinesIn(fn any) int {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+
+		buf = make([]byte, 2*len(buf))
+	}
+
+	return bytes.Count(buf, []byte(name+"("))
+}
+
+func waitFor(t *testing.T, what string, timeout time.Duration, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal(fmt.Sprintf("timed out waiting for %s", what))
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// the log is written from background goroutines so reads
+// of it have to take the same lock
+type logBuffer struct {
+	lk  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(b []byte) (int, error) {
+	lb.lk.Lock()
+	defer lb.lk.Unlock()
+	return lb.buf.Write(b)
+}
+
+func (lb *logBuffer) String() string {
+	lb.lk.Lock()
+	defer lb.lk.Unlock()
+	return lb.buf.String()
+}
+
+// collects what is logged until the test ends
+func captureLog(t *testing.T) *logBuffer {
+	lb := &logBuffer{}
+	log.SetOutput(lb)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return lb
+}
+
+func TestWriteTimeoutReleasesWedgedClient(t *testing.T) {
+	// well past what loopback socket buffers soak up
+	body := bytes.Repeat([]byte("x"), 16<<20)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write(body)
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-write-timeout", "200ms")
+	if _, got := get(t, base+"/big"); len(got) != len(body) {
+		t.Fatal(fmt.Sprintf("filled with %d bytes, want %d", len(got), len(body)))
+	}
+
+	// asks for it again and never reads
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /big HTTP/1.1\r\nHost: proxy\r\n\r\n")
+
+	waitFor(t, "the cached response to be served", 5*time.Second, func() bool {
+		return goroutinesIn(serveCached) > 0
+	})
+
+	start := time.Now()
+	waitFor(t, "the serving goroutine to give up", 5*time.Second, func() bool {
+		return goroutinesIn(serveCached) == 0
+	})
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal(fmt.Sprintf("serving goroutine took %s to exit with a 200ms write timeout", elapsed))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+// what is held for method and path, keyed as stored so
+// variants of it can be told apart. the client can have
+// its response before the fill is done with, so this
+// waits for any that are pending to settle either way
+func cachedEntries(t *testing.T, c *Cache, method string, path string) map[string]*CachedResponse {
+	t.Helper()
+
+	var entries map[string]*CachedResponse
+	waitFor(t, "fills of "+path+" to finish", 5*time.Second, func() bool {
+		c.lk.Lock()
+		defer c.lk.Unlock()
+
+		entries = make(map[string]*CachedResponse)
+		for key, cr := range c.cache {
+			base := strings.SplitN(key, variantSep, 2)[0]
+			if !strings.HasPrefix(base, method) || !strings.HasSuffix(base, path) {
+				continue
+			}
+
+			if cr.pending() {
+				return false
+			}
+
+			entries[key] = cr
+		}
+
+		return true
+	})
+
+	return entries
+}
+
+// the one GET entry for path, nil if there isn't exactly one
+func cachedEntry(t *testing.T, c *Cache, path string) *CachedResponse {
+	t.Helper()
+
+	entries := cachedEntries(t, c, "GET", path)
+	if len(entries) != 1 {
+		return nil
+	}
+
+	for _, cr := range entries {
+		return cr
+	}
+
+	return nil
+}
+
+// the cached copy can no longer be read, as if the store
+// behind it had failed
+func breakCachedBody(t *testing.T, c *Cache, path string) {
+	t.Helper()
+
+	cr := cachedEntry(t, c, path)
+	if cr == nil {
+		t.Fatal("nothing cached for " + path)
+	}
+
+	cr.Body = nil
+}
+
+func TestServeErrorBeforeHeadersRefetches(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "hello")
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c")
+	get(t, base+"/a")
+	breakCachedBody(t, cache, "/a")
+
+	res, body := get(t, base+"/a")
+	if res.StatusCode != http.StatusOK || body != "hello" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the origin's response", res.StatusCode, body))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestServeErrorBeforeHeadersWithoutRefetchIs502(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "hello")
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-refetch-on-serve-error=false")
+	get(t, base+"/a")
+	breakCachedBody(t, cache, "/a")
+
+	if res, _ := get(t, base+"/a"); res.StatusCode != http.StatusBadGateway {
+		t.Fatal(fmt.Sprintf("got %d, want 502", res.StatusCode))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+}
+
+// takes the status line and fails on the body
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	status int
+}
+
+func (fw *failingWriter) WriteHeader(code int) {
+	fw.status = code
+	fw.ResponseRecorder.WriteHeader(code)
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("client went away")
+}
+
+func TestServeErrorAfterHeadersAborts(t *testing.T) {
+	o := testOptions(t, "")
+	cr := &CachedResponse{Header: http.Header{}, StatusCode: http.StatusOK, Body: []byte("hello")}
+	rw := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Fatal(fmt.Sprintf("recovered %v, want http.ErrAbortHandler", err))
+		}
+
+		if rw.status != http.StatusOK {
+			t.Fatal(fmt.Sprintf("status %d was sent, want 200", rw.status))
+		}
+	}()
+
+	serveCached(o, rw, httptest.NewRequest("GET", "/a", nil), cr)
+	t.Fatal("serveCached returned after the headers had gone out")
+}
+
+// a document that PUT replaces, guarded by If-Match
+func versionedOrigin(t *testing.T) *testOrigin {
+	var version atomic.Int64
+	version.Store(1)
+
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"v%d"`, version.Load())
+
+		switch r.Method {
+		case "PUT", "PATCH":
+			if m := r.Header.Get("If-Match"); m != "" && m != etag {
+				rw.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+
+			version.Add(1)
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("ETag", etag)
+			io.WriteString(rw, etag)
+		}
+	})
+}
+
+func TestSuccessfulPutInvalidatesCachedGet(t *testing.T) {
+	origin := versionedOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/doc")
+	if _, body := get(t, base+"/doc"); body != `"v1"` {
+		t.Fatal(fmt.Sprintf("got %s, want v1", body))
+	}
+
+	res, _ := request(t, "PUT", base+"/doc", "If-Match", `"v1"`)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal(fmt.Sprintf("PUT got %d, want the origin's 204", res.StatusCode))
+	}
+
+	if _, body := get(t, base+"/doc"); body != `"v2"` {
+		t.Fatal(fmt.Sprintf("GET after PUT got %s, want v2 from the origin", body))
+	}
+
+	if n := origin.requests.Load(); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 3", n))
+	}
+}
+
+func TestFailedPreconditionKeepsCachedGet(t *testing.T) {
+	origin := versionedOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/doc")
+
+	res, _ := request(t, "PUT", base+"/doc", "If-Match", `"v0"`)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatal(fmt.Sprintf("PUT got %d, want the origin's 412", res.StatusCode))
+	}
+
+	get(t, base+"/doc")
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the GET still cached", n))
+	}
+}
+
+func TestPostInvalidatesCachedGet(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, r.Method)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/items")
+	request(t, "POST", base+"/items")
+
+	if cachedEntry(t, cache, "/items") != nil {
+		t.Fatal("GET entry still cached after a POST to the same URL")
+	}
+
+	get(t, base+"/items")
+	if n := origin.requests.Load(); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 3", n))
+	}
+}
+
+func TestUnsafeMethodInvalidatesLocationTargets(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			rw.Header().Set("Location", "/items/1")
+			rw.Header().Set("Content-Location", "/items/latest")
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			// another host's URL mustn't purge ours
+			rw.Header().Set("Location", "http://elsewhere.example/items/2")
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, r.URL.Path)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c")
+
+	for _, path := range []string{"/items/1", "/items/2", "/items/latest"} {
+		get(t, base+path)
+	}
+
+	if res, _ := request(t, "POST", base+"/items"); res.StatusCode != http.StatusCreated {
+		t.Fatal(fmt.Sprintf("POST got %d, want the origin's 201", res.StatusCode))
+	}
+
+	if cachedEntry(t, cache, "/items/1") != nil {
+		t.Fatal("Location target still cached after the POST")
+	}
+
+	if cachedEntry(t, cache, "/items/latest") != nil {
+		t.Fatal("Content-Location target still cached after the POST")
+	}
+
+	request(t, "DELETE", base+"/items/3")
+	if cachedEntry(t, cache, "/items/2") == nil {
+		t.Fatal("a Location on another host invalidated our entry")
+	}
+}
+
+func TestFailedUnsafeMethodKeepsCachedGet(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "item")
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/items/1")
+	request(t, "DELETE", base+"/items/1")
+
+	if cachedEntry(t, cache, "/items/1") == nil {
+		t.Fatal("a failed DELETE invalidated the cached GET")
+	}
+}
+
+// moves path's entry back in time, as if it had been stored
+// by ago and had aged since
+func age(t *testing.T, c *Cache, path string, by time.Duration) {
+	t.Helper()
+
+	cr := cachedEntry(t, c, path)
+	if cr == nil {
+		t.Fatal("nothing cached for " + path)
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	cr.Stored = cr.Stored.Add(-by)
+	if !cr.Expires.IsZero() {
+		cr.Expires = cr.Expires.Add(-by)
+	}
+}
+
+// ASCII only, unicode case mappings don't round trip
+func upperASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return r
+	}, s)
+}
+
+func FuzzGetKey(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"/",
+		"*",
+		"/a/b?c=d&e",
+		"/a%2Fb",
+		"/a/b",
+		"/%zz",
+		"//evil.example/x",
+		"http://Example.COM:80/x",
+		"https://example.com:443/x?",
+		"http://[::1]:8080/a b",
+		"mailto:someone@example.com",
+	} {
+		f.Add("GET", seed)
+	}
+	f.Add("OPTIONS", "*")
+
+	f.Fuzz(func(t *testing.T, method string, raw string) {
+		// hand built requests may not have a URL
+		getKey(&http.Request{Method: method})
+
+		u, err := url.Parse(raw)
+		if err != nil {
+			return
+		}
+
+		key := getKey(&http.Request{Method: method, URL: u})
+		if !strings.HasPrefix(key, method) {
+			t.Fatal(fmt.Sprintf("key %q doesn't start with its method %q", key, method))
+		}
+
+		upper := *u
+		upper.Host = upperASCII(u.Host)
+		if getKey(&http.Request{Method: method, URL: &upper}) != key {
+			t.Fatal(fmt.Sprintf("host case changed the key for %q", raw))
+		}
+	})
+}
+
+func TestEscapedSlashHasItsOwnKey(t *testing.T) {
+	escaped, _ := url.Parse("/a%2Fb")
+	plain, _ := url.Parse("/a/b")
+
+	if urlKey("GET", escaped) == urlKey("GET", plain) {
+		t.Fatal("/a%2Fb and /a/b share a key")
+	}
+}
+
+func TestNoGoroutinesLeftAfterManyFetches(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/uncacheable" {
+			rw.Header().Set("Cache-Control", "no-store")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=60")
+		}
+		io.WriteString(rw, r.URL.Path)
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c")
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// misses, hits and fills that are thrown away
+	for i := 0; i < 200; i++ {
+		get(t, base+fmt.Sprintf("/%d", i%50))
+		get(t, base+"/uncacheable")
+	}
+}
+
+// for use off the test goroutine, where t.Fatal can't be
+func fetch(ctx context.Context, u string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := testTransport.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestNoGoroutinesLeftWaitingOnAFill(t *testing.T) {
+	release := make(chan struct{})
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, r.URL.Path)
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c")
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// nobody waiting
+	if _, body := get(t, base+"/solo"); body != "/solo" {
+		t.Fatal(fmt.Sprintf("got %q, want /solo", body))
+	}
+
+	const waiters = 10
+	bodies := make(chan string, waiters)
+	errs := make(chan error, waiters+1)
+
+	var wg sync.WaitGroup
+	wait := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := fetch(context.Background(), base+"/slow")
+			if err != nil {
+				errs <- err
+			}
+			bodies <- body
+		}()
+	}
+
+	// the first fills, cancelling it would cancel the fill
+	wait()
+	waitFor(t, "the fill to start", 5*time.Second, func() bool {
+		return origin.requests.Load() == 2
+	})
+
+	for i := 1; i < waiters; i++ {
+		wait()
+	}
+
+	// and one that gives up before the fill is done
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := fetch(ctx, base+"/slow"); err == nil {
+			errs <- errors.New("a cancelled request got a response")
+		}
+	}()
+
+	waitFor(t, "the rest to wait on the fill", 5*time.Second, func() bool {
+		return goroutinesIn((*Cache).Get) == waiters
+	})
+
+	cancel()
+	close(release)
+	wg.Wait()
+	close(bodies)
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for body := range bodies {
+		if body != "/slow" {
+			t.Fatal(fmt.Sprintf("a waiter got %q, want /slow", body))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want /solo and a single /slow", n))
+	}
+}
+
+func TestCorruptedBodyIsRefetched(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "the real body")
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-verify-checksum")
+	get(t, base+"/a")
+
+	cr := cachedEntry(t, cache, "/a")
+	if cr == nil {
+		t.Fatal("nothing cached for /a")
+	}
+
+	cr.Body[0] ^= 0xff
+
+	if _, body := get(t, base+"/a"); body != "the real body" {
+		t.Fatal(fmt.Sprintf("got %q, want the origin's body", body))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the corrupted entry refetched", n))
+	}
+
+	// and the good copy is what's held now
+	get(t, base+"/a")
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests after the refetch, want 2", n))
+	}
+}
+
+func TestAuthorizedRequestsBypassTheCache(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "for "+r.Header.Get("Authorization"))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-bypass-authorized")
+
+	// an anonymous copy is cached, but never served to them
+	get(t, base+"/me")
+
+	for _, token := range []string{"Bearer alice", "Bearer bob"} {
+		if _, body := get(t, base+"/me", "Authorization", token); body != "for "+token {
+			t.Fatal(fmt.Sprintf("%s got %q", token, body))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want every authorized one", n))
+	}
+
+	if cr := cachedEntry(t, cache, "/me"); cr == nil || string(cr.Body) != "for " {
+		t.Fatal("an authorized response without public was cached")
+	}
+}
+
+func TestAuthorizedPublicResponsesAreCached(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(rw, "the same for everyone")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-bypass-authorized")
+
+	get(t, base+"/news", "Authorization", "Bearer alice")
+	if _, body := get(t, base+"/news"); body != "the same for everyone" {
+		t.Fatal(fmt.Sprintf("got %q", body))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the public response cached", n))
+	}
+}
+
+func TestTuneTransportKeepsDefaultsForZero(t *testing.T) {
+	tr := &http.Transport{IdleConnTimeout: time.Minute, ExpectContinueTimeout: time.Second}
+	tuneTransport(tr, 0, 0)
+
+	if tr.IdleConnTimeout != time.Minute || tr.ExpectContinueTimeout != time.Second {
+		t.Fatal(fmt.Sprintf("zero changed the transport to %s and %s", tr.IdleConnTimeout, tr.ExpectContinueTimeout))
+	}
+
+	tuneTransport(tr, 5*time.Second, 2*time.Second)
+
+	if tr.IdleConnTimeout != 5*time.Second || tr.ExpectContinueTimeout != 2*time.Second {
+		t.Fatal(fmt.Sprintf("transport was left with %s and %s", tr.IdleConnTimeout, tr.ExpectContinueTimeout))
+	}
+}
+
+func TestIdleUpstreamConnectionsAreClosed(t *testing.T) {
+	var conns atomic.Int64
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	// a copy, as the proxy's is shared by every test
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	defer tr.CloseIdleConnections()
+	tuneTransport(tr, 100*time.Millisecond, 0)
+
+	client := &http.Client{Transport: tr}
+	for _, wait := range []time.Duration{0, 10 * time.Millisecond, 300 * time.Millisecond} {
+		time.Sleep(wait)
+
+		res, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	// reused straight away, then dropped once idle too long
+	if n := conns.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d connections, want 2", n))
+	}
+}
+
+func TestHostCaseAndDefaultPortShareAnEntry(t *testing.T) {
+	for _, c := range []struct {
+		stored string
+		same   []string
+		other  []string
+	}{
+		{
+			"http://example.com/x",
+			[]string{"http://Example.COM/x", "http://example.com:80/x", "HTTP://EXAMPLE.com:80/x"},
+			[]string{"http://example.com:8080/x", "https://example.com/x", "http://example.com/X"},
+		},
+		{
+			"https://example.com/x",
+			[]string{"https://EXAMPLE.com:443/x", "HTTPS://example.com/x"},
+			[]string{"https://example.com:80/x", "http://example.com:443/x"},
+		},
+	} {
+		cache := newCache(testOptions(t, "", "-c"))
+		cr := cache.Create(httptest.NewRequest("GET", c.stored, nil), nil)
+		cr.completeUpdate()
+
+		for _, u := range c.same {
+			if cache.Get(httptest.NewRequest("GET", u, nil)) != cr {
+				t.Fatal(fmt.Sprintf("%s didn't find what was stored for %s", u, c.stored))
+			}
+		}
+
+		for _, u := range c.other {
+			if cache.Get(httptest.NewRequest("GET", u, nil)) != nil {
+				t.Fatal(fmt.Sprintf("%s found what was stored for %s", u, c.stored))
+			}
+		}
+	}
+}
+
+// every path names the one it was asked for as its
+// Content-Location, given as ?at=
+func contentLocationOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		if at := r.URL.Query().Get("at"); at != "" {
+			rw.Header().Set("Content-Location", at)
+		}
+		io.WriteString(rw, "content")
+	})
+}
+
+func TestContentLocationIsIndexed(t *testing.T) {
+	for _, c := range []struct {
+		path      string
+		canonical string
+	}{
+		{"/page?at=/canonical", "/canonical"},
+		{"/docs/page?at=canonical", "/docs/canonical"},
+	} {
+		origin := contentLocationOrigin(t)
+		base, _ := newProxy(t, origin.URL, "-c", "-index-content-location")
+
+		get(t, base+c.path)
+		if _, body := get(t, base+c.canonical); body != "content" {
+			t.Fatal(fmt.Sprintf("%s was served %q", c.canonical, body))
+		}
+
+		if n := origin.requests.Load(); n != 1 {
+			t.Fatal(fmt.Sprintf("%s wasn't a hit after %s, origin saw %d requests", c.canonical, c.path, n))
+		}
+	}
+}
+
+func TestContentLocationIsNotIndexedElsewhere(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		args []string
+	}{
+		// another host's URL is never stored here
+		{"/page?at=http://other.example/canonical", []string{"-c", "-index-content-location"}},
+		{"/page?at=/canonical", []string{"-c"}},
+	} {
+		origin := contentLocationOrigin(t)
+		base, _ := newProxy(t, origin.URL, c.args...)
+
+		get(t, base+c.path)
+		get(t, base+"/canonical")
+
+		if n := origin.requests.Load(); n != 2 {
+			t.Fatal(fmt.Sprintf("%v: /canonical was a hit after %s", c.args, c.path))
+		}
+	}
+}
+
+// net/http stops at Content-Length itself, so the origin's
+// response is built by hand to run past it
+func overlongResponse(declared int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Length": {fmt.Sprint(declared)}, "Cache-Control": {"max-age=60"}},
+		ContentLength: int64(declared),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestOverlongBodyIsTruncatedAndNotCached(t *testing.T) {
+	o := testOptions(t, "", "-c")
+	req := httptest.NewRequest("GET", "http://origin.example/a", nil)
+
+	cr := &CachedResponse{}
+	if fill(o, req, cr, overlongResponse(5, "hello\r\n\r\nHTTP/1.1 200 OK")) {
+		t.Fatal("a body longer than its Content-Length was cacheable")
+	}
+
+	if string(cr.Body) != "hello" {
+		t.Fatal(fmt.Sprintf("served %q, want it cut to its Content-Length", cr.Body))
+	}
+
+	cr = &CachedResponse{}
+	if !fill(o, req, cr, overlongResponse(5, "hello")) || string(cr.Body) != "hello" {
+		t.Fatal(fmt.Sprintf("a body of its Content-Length wasn't cached, got %q", cr.Body))
+	}
+}
+
+func TestShortBodyIsServedButNotCached(t *testing.T) {
+	o := testOptions(t, "", "-c")
+	req := httptest.NewRequest("GET", "http://origin.example/a", nil)
+
+	for _, res := range []*http.Response{
+		// the connection dropped part way through
+		overlongResponse(5, "hel"),
+		{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Length": {"5"}, "Cache-Control": {"max-age=60"}},
+			ContentLength: 5,
+			Body:          io.NopCloser(io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(io.ErrUnexpectedEOF))),
+		},
+		// no length to go by, only the read error
+		{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": {"max-age=60"}},
+			Body:       io.NopCloser(io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(io.ErrUnexpectedEOF))),
+		},
+	} {
+		cr := &CachedResponse{}
+		if fill(o, req, cr, res) {
+			t.Fatal(fmt.Sprintf("a body cut short with Content-Length %q was cacheable", res.Header.Get("Content-Length")))
+		}
+
+		if string(cr.Body) != "hel" {
+			t.Fatal(fmt.Sprintf("served %q, want what arrived", cr.Body))
+		}
+	}
+}
+
+func TestDroppedOriginBodyIsNotCached(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\nContent-Length: 100\r\n\r\npart of it")
+		buf.Flush()
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c")
+	for i := 0; i < 2; i++ {
+		fetch(context.Background(), base+"/a")
+	}
+
+	if cachedEntry(t, cache, "/a") != nil {
+		t.Fatal("a body cut short by the origin was cached")
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestHeadSharesAnInFlightGet(t *testing.T) {
+	release := make(chan struct{})
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("X-Method", r.Method)
+		io.WriteString(rw, "body")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-coalesce-head")
+
+	got := make(chan string, 1)
+	go func() {
+		body, _ := fetch(context.Background(), base+"/a")
+		got <- body
+	}()
+
+	waitFor(t, "the GET to reach the origin", 5*time.Second, func() bool {
+		return origin.requests.Load() == 1
+	})
+
+	head := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest("HEAD", base+"/a", nil)
+		res, err := testTransport.RoundTrip(req)
+		if err != nil {
+			head <- nil
+			return
+		}
+		res.Body.Close()
+		head <- res
+	}()
+
+	waitFor(t, "the HEAD to wait on the GET", 5*time.Second, func() bool {
+		return goroutinesIn((*Cache).Get) > 0
+	})
+	close(release)
+
+	res := <-head
+	if res == nil || res.StatusCode != http.StatusOK || res.Header.Get("X-Method") != "GET" {
+		t.Fatal(fmt.Sprintf("HEAD wasn't answered from the GET, got %v", res))
+	}
+
+	if body := <-got; body != "body" {
+		t.Fatal(fmt.Sprintf("GET got %q", body))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the HEAD to share the GET's", n))
+	}
+}
+
+// has the proxy's transport trust origin's certificate
+// until the test ends
+func trustOrigin(t *testing.T, origin *httptest.Server) {
+	tr := http.DefaultTransport.(*http.Transport)
+	old := tr.TLSClientConfig
+	tr.TLSClientConfig = origin.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	t.Cleanup(func() {
+		tr.TLSClientConfig = old
+		tr.CloseIdleConnections()
+	})
+}
+
+func TestOriginIsReachedWithItsOwnScheme(t *testing.T) {
+	handler := func(rw http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			io.WriteString(rw, "https")
+		} else {
+			io.WriteString(rw, "http")
+		}
+	}
+
+	httpOrigin := httptest.NewServer(http.HandlerFunc(handler))
+	defer httpOrigin.Close()
+	httpsOrigin := httptest.NewTLSServer(http.HandlerFunc(handler))
+	defer httpsOrigin.Close()
+	trustOrigin(t, httpsOrigin)
+
+	for _, c := range []struct {
+		clientTLS bool
+		target    string
+		args      []string
+		want      string
+	}{
+		{false, httpOrigin.URL, nil, "http"},
+		{true, httpOrigin.URL, nil, "http"},
+		{false, httpsOrigin.URL, nil, "https"},
+		{true, httpsOrigin.URL, nil, "https"},
+		// -upstream-scheme over whatever the target says
+		{true, "http://" + httpsOrigin.Listener.Addr().String(), []string{"-upstream-scheme", "https"}, "https"},
+		{false, "https://" + httpOrigin.Listener.Addr().String(), []string{"-upstream-scheme", "HTTP"}, "http"},
+	} {
+		for _, cache := range []string{"", "-c"} {
+			args := c.args
+			if cache != "" {
+				args = append([]string{cache}, args...)
+			}
+
+			handler, _ := newProxyHandler(testOptions(t, c.target, args...))
+			proxy := httptest.NewUnstartedServer(handler)
+			if c.clientTLS {
+				proxy.StartTLS()
+			} else {
+				proxy.Start()
+			}
+
+			res, err := proxy.Client().Get(proxy.URL + "/scheme")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			proxy.Close()
+
+			if string(body) != c.want {
+				t.Fatal(fmt.Sprintf("client over TLS %t to %s %v reached the origin over %q, want %s", c.clientTLS, c.target, args, body, c.want))
+			}
+		}
+	}
+}
+
+func TestUpstreamSchemeRejectsOthers(t *testing.T) {
+	if err := validUpstreamScheme("ftp"); err == nil {
+		t.Fatal("ftp was accepted")
+	}
+}
+
+// a large entry written to a client shouldn't cost a copy
+// of itself, with or without a checksum to check
+func TestWriteToDoesNotCopyTheBody(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 1<<20)
+
+	for _, checksum := range []bool{false, true} {
+		cr := &CachedResponse{StatusCode: http.StatusOK, Body: body}
+		if checksum {
+			cr.checksum = crc32.ChecksumIEEE(body)
+			cr.hasChecksum = true
+		}
+
+		allocs := testing.AllocsPerRun(10, func() {
+			if _, err := cr.WriteTo(io.Discard); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if allocs != 0 {
+			t.Fatal(fmt.Sprintf("checksum %v: %.0f allocations writing a cached body", checksum, allocs))
+		}
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	cr := &CachedResponse{StatusCode: http.StatusOK, Body: bytes.Repeat([]byte("a"), 1<<20)}
+
+	b.SetBytes(int64(len(cr.Body)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := cr.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
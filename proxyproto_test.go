@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serves the address each request appears to come from
+func remoteAddrServer(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, r.RemoteAddr)
+	})}
+	go srv.Serve(&proxyProtoListener{ln})
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func remoteAddrFor(t *testing.T, addr string, preamble []byte) (string, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(preamble)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestProxyProtocolV1SetsRemoteAddr(t *testing.T) {
+	addr := remoteAddrServer(t)
+
+	for preamble, want := range map[string]string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n":   "203.0.113.7:56324",
+		"PROXY TCP6 2001:db8::7 2001:db8::1 4000 443\r\n": "[2001:db8::7]:4000",
+	} {
+		got, err := remoteAddrFor(t, addr, []byte(preamble))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Fatal(fmt.Sprintf("%q gave RemoteAddr %s, want %s", strings.TrimSpace(preamble), got, want))
+		}
+	}
+}
+
+func TestProxyProtocolV1UnknownKeepsPeerAddr(t *testing.T) {
+	addr := remoteAddrServer(t)
+
+	got, err := remoteAddrFor(t, addr, []byte("PROXY UNKNOWN\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Fatal(fmt.Sprintf("RemoteAddr %s, want the peer's", got))
+	}
+}
+
+func TestProxyProtocolV2SetsRemoteAddr(t *testing.T) {
+	addr := remoteAddrServer(t)
+
+	// PROXY over TCP4 from 198.51.100.9:1234 to 10.0.0.1:443
+	preamble := append([]byte{}, proxyV2Signature...)
+	preamble = append(preamble, 0x21, 0x11, 0, 12)
+	preamble = append(preamble, 198, 51, 100, 9, 10, 0, 0, 1)
+	preamble = binary.BigEndian.AppendUint16(preamble, 1234)
+	preamble = binary.BigEndian.AppendUint16(preamble, 443)
+
+	got, err := remoteAddrFor(t, addr, preamble)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "198.51.100.9:1234" {
+		t.Fatal(fmt.Sprintf("RemoteAddr %s, want 198.51.100.9:1234", got))
+	}
+}
+
+func TestConnectionWithoutProxyHeaderIsRejected(t *testing.T) {
+	addr := remoteAddrServer(t)
+
+	if got, err := remoteAddrFor(t, addr, nil); err == nil {
+		t.Fatal(fmt.Sprintf("served %q to a connection with no PROXY header", got))
+	}
+}
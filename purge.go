@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// drops every variant of the GET and HEAD entries for each
+// of urls under one hold of the lock, so a long list costs
+// little more than a single URL does
+func (c *Cache) InvalidateAll(urls []*url.URL) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	bases := make(map[string]*cachePool)
+	for _, u := range urls {
+		p := c.pool(&http.Request{URL: u})
+		for _, method := range []string{"GET", "HEAD"} {
+			bases[urlKey(method, u)] = p
+		}
+	}
+
+	for base, p := range bases {
+		for key := range c.variants[base] {
+			p.remove(key)
+			delete(c.cache, key)
+		}
+
+		delete(c.variants, base)
+	}
+
+	for key := range c.segments {
+		if p, ok := bases[baseOf(key)]; ok {
+			p.remove(key)
+			delete(c.segments, key)
+		}
+	}
+
+	// nor should anything evicted come back
+	if g := c.graveyard; g != nil {
+		for key := range g.entries {
+			if _, ok := bases[baseOf(key)]; ok {
+				g.remove(key)
+			}
+		}
+	}
+}
+
+type purgeBatch struct {
+	urls map[string]*url.URL
+	done chan struct{}
+}
+
+// purges that arrive while a batch is being applied wait
+// for the next one together, and the same URL asked for
+// twice is only purged once, so a deploy script purging
+// thousands of URLs takes the cache lock a handful of
+// times rather than thousands
+type purger struct {
+	cache   *Cache
+	lk      sync.Mutex
+	next    *purgeBatch
+	running bool
+}
+
+// returns once urls are gone from the cache
+func (p *purger) purge(urls []*url.URL) {
+	p.lk.Lock()
+	if p.next == nil {
+		p.next = &purgeBatch{urls: make(map[string]*url.URL), done: make(chan struct{})}
+	}
+
+	b := p.next
+	for _, u := range urls {
+		b.urls[urlKey("GET", u)] = u
+	}
+
+	if !p.running {
+		p.running = true
+		go p.run()
+	}
+	p.lk.Unlock()
+
+	<-b.done
+}
+
+func (p *purger) run() {
+	for {
+		p.lk.Lock()
+		b := p.next
+		p.next = nil
+		if b == nil {
+			p.running = false
+			p.lk.Unlock()
+			return
+		}
+		p.lk.Unlock()
+
+		urls := make([]*url.URL, 0, len(b.urls))
+		for _, u := range b.urls {
+			urls = append(urls, u)
+		}
+
+		p.cache.InvalidateAll(urls)
+		close(b.done)
+	}
+}
+
+// POST /_cache/purge?url=/a&url=/b drops what is held for
+// each path, in every variant
+func (a *adminServer) purge(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var urls []*url.URL
+	for _, raw := range r.URL.Query()["url"] {
+		ref, err := url.Parse(raw)
+		if err != nil || ref.Path == "" {
+			writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "invalid url to purge " + raw})
+			return
+		}
+
+		// keyed as the request that filled it went upstream
+		out := &http.Request{URL: &url.URL{Path: ref.Path, RawPath: ref.RawPath, RawQuery: ref.RawQuery}}
+		ensureScheme(out, a.o)
+		urls = append(urls, out.URL)
+	}
+
+	if len(urls) == 0 {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "a url to purge is required"})
+		return
+	}
+
+	a.purger.purge(urls)
+	rw.WriteHeader(http.StatusNoContent)
+}
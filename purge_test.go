@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func cacheWith(t *testing.T, paths ...string) *Cache {
+	cache := newCache(testOptions(t, "", "-c"))
+	for _, path := range paths {
+		cache.Create(httptest.NewRequest("GET", "http://origin.example"+path, nil), nil).completeUpdate()
+	}
+
+	return cache
+}
+
+func held(cache *Cache, path string) bool {
+	return cache.Get(httptest.NewRequest("GET", "http://origin.example"+path, nil)) != nil
+}
+
+func TestConcurrentPurgesAreBatched(t *testing.T) {
+	var paths []string
+	for i := 0; i < 100; i++ {
+		paths = append(paths, fmt.Sprintf("/%d", i))
+	}
+
+	cache := cacheWith(t, append(paths, "/keep")...)
+	p := &purger{cache: cache}
+
+	purge := func(path string, wg *sync.WaitGroup) {
+		defer wg.Done()
+		u, _ := url.Parse("http://origin.example" + path)
+		p.purge([]*url.URL{u})
+	}
+
+	// the first batch waits on the cache lock, so all the
+	// rest arrive while it is being applied
+	cache.lk.Lock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go purge(paths[0], &wg)
+
+	waitFor(t, "the first batch to be taken", 5*time.Second, func() bool {
+		p.lk.Lock()
+		defer p.lk.Unlock()
+		return p.running && p.next == nil
+	})
+
+	// every URL twice
+	for _, path := range append(paths[1:], paths[1:]...) {
+		wg.Add(1)
+		go purge(path, &wg)
+	}
+
+	waitFor(t, "the rest to be batched", 5*time.Second, func() bool {
+		p.lk.Lock()
+		defer p.lk.Unlock()
+		return p.next != nil && len(p.next.urls) == len(paths)-1
+	})
+	cache.lk.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purges didn't all return")
+	}
+
+	for _, path := range paths {
+		if held(cache, path) {
+			t.Fatal(path + " wasn't purged")
+		}
+	}
+
+	if !held(cache, "/keep") {
+		t.Fatal("an entry nobody purged went")
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.running || p.next != nil {
+		t.Fatal("purger still running with nothing to do")
+	}
+}
+
+func TestConcurrentAdminPurges(t *testing.T) {
+	origin := cacheableOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-admin-token", testAdminToken)
+
+	for i := 0; i < 50; i++ {
+		get(t, base+fmt.Sprintf("/%d", i))
+	}
+	get(t, base+"/keep")
+
+	var wg sync.WaitGroup
+	failed := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("POST", base+fmt.Sprintf("/_cache/purge?url=/%d&url=/%d", i, (i+1)%50), nil)
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+			res, err := testTransport.RoundTrip(req)
+			if err != nil {
+				failed <- 0
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusNoContent {
+				failed <- res.StatusCode
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(failed)
+
+	for status := range failed {
+		t.Fatal(fmt.Sprintf("a purge got %d, want 204", status))
+	}
+
+	before := origin.requests.Load()
+	for i := 0; i < 50; i++ {
+		get(t, base+fmt.Sprintf("/%d", i))
+	}
+	get(t, base+"/keep")
+
+	if n := origin.requests.Load() - before; n != 50 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests after purging 50 paths, want 50", n))
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sonewman/rox"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inclusive on both ends, as in the Range header
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// only single, closed ranges (bytes=0-499) are cached,
+// anything else is left to the regular cache path
+func parseRange(h string) (byteRange, bool) {
+	if !strings.HasPrefix(h, "bytes=") || strings.Contains(h, ",") {
+		return byteRange{}, false
+	}
+
+	bounds := strings.SplitN(strings.TrimPrefix(h, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return byteRange{}, false
+	}
+
+	start, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64)
+	if err != nil {
+		return byteRange{}, false
+	}
+
+	end, err := strconv.ParseInt(strings.TrimSpace(bounds[1]), 10, 64)
+	if err != nil || start < 0 || end < start {
+		return byteRange{}, false
+	}
+
+	return byteRange{start, end}, true
+}
+
+// bytes 0-499/1234, size is -1 when given as *
+func parseContentRange(h string) (byteRange, int64, bool) {
+	if !strings.HasPrefix(h, "bytes ") {
+		return byteRange{}, 0, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(h, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return byteRange{}, 0, false
+	}
+
+	r, ok := parseRange("bytes=" + parts[0])
+	if !ok {
+		return byteRange{}, 0, false
+	}
+
+	if parts[1] == "*" {
+		return r, -1, true
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size <= r.end {
+		return byteRange{}, 0, false
+	}
+
+	return r, size, true
+}
+
+// for large media we only hold on to the parts of the
+// object that have actually been asked for. each part has
+// its own expiry as it was fetched at its own time
+type SegmentedResponse struct {
+	lk       sync.Mutex
+	Header   http.Header
+	Size     int64
+	Segments map[byteRange]*segment
+}
+
+type segment struct {
+	body    []byte
+	expires time.Time
+}
+
+// segments are held in their URL's pool under a key of
+// their own, which still starts with the URL's so purges
+// and invalidation find them
+const segmentsSuffix = variantSep + "\x01segments"
+
+func segmentsKey(key string) string {
+	return key + segmentsSuffix
+}
+
+// header and size are as they were for the segment found,
+// a new version may replace them at any time after
+func (sr *SegmentedResponse) Get(r byteRange, now time.Time) ([]byte, byteRange, http.Header, int64, bool) {
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+
+	// past the end is for the origin to answer with a 416,
+	// there's nothing of ours to serve
+	if sr.Size > 0 && r.start >= sr.Size {
+		return nil, r, nil, 0, false
+	}
+
+	if sr.Size > 0 && r.end >= sr.Size {
+		r.end = sr.Size - 1
+	}
+
+	for seg, s := range sr.Segments {
+		if seg.start <= r.start && r.end <= seg.end && (s.expires.IsZero() || now.Before(s.expires)) {
+			return s.body[r.start-seg.start : r.end-seg.start+1], r, sr.Header, sr.Size, true
+		}
+	}
+
+	return nil, r, nil, 0, false
+}
+
+// a different ETag or Last-Modified means a new version of
+// the object, which the segments we have aren't part of
+func (sr *SegmentedResponse) Set(header http.Header, r byteRange, size int64, body []byte, expires time.Time, now time.Time) {
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+
+	if sr.Header != nil && (sr.Header.Get("ETag") != header.Get("ETag") ||
+		sr.Header.Get("Last-Modified") != header.Get("Last-Modified")) {
+		sr.Header = nil
+		sr.Size = 0
+		sr.Segments = make(map[byteRange]*segment)
+	}
+
+	if sr.Header == nil {
+		h := make(http.Header)
+		rox.CopyHeader(h, header)
+		h.Del("Content-Range")
+		h.Del("Content-Length")
+		sr.Header = h
+	}
+
+	if size > 0 {
+		sr.Size = size
+	}
+
+	for seg, s := range sr.Segments {
+		if !s.expires.IsZero() && !now.Before(s.expires) {
+			delete(sr.Segments, seg)
+		}
+	}
+
+	sr.Segments[r] = &segment{body: body, expires: expires}
+}
+
+func (sr *SegmentedResponse) size() int {
+	sr.lk.Lock()
+	defer sr.lk.Unlock()
+
+	n := 0
+	for name, values := range sr.Header {
+		n += len(name)
+		for _, v := range values {
+			n += len(v)
+		}
+	}
+
+	for _, s := range sr.Segments {
+		n += len(s.body)
+	}
+
+	return n
+}
+
+// nil until a segment has been stored for req
+func (c *Cache) Segments(req *http.Request) *SegmentedResponse {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	key := segmentsKey(c.key(req))
+	sr := c.segments[key]
+	if sr != nil {
+		c.pool(req).touch(key)
+	}
+
+	return sr
+}
+
+// stored segments count towards the pool like any entry
+func (c *Cache) StoreSegment(req *http.Request, header http.Header, r byteRange, size int64, body []byte, expires time.Time) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	key := segmentsKey(c.key(req))
+	p := c.pool(req)
+
+	sr := c.segments[key]
+	if sr == nil {
+		sr = &SegmentedResponse{Segments: make(map[byteRange]*segment)}
+		c.segments[key] = sr
+		p.add(key)
+	}
+
+	sr.Set(header, r, size, body, expires, time.Now())
+	p.resize(key, sr.size())
+	c.evict(p, "")
+}
+
+func writeSegment(rw http.ResponseWriter, header http.Header, total int64, r byteRange, b []byte) {
+	size := "*"
+	if total > 0 {
+		size = strconv.FormatInt(total, 10)
+	}
+
+	rox.CopyHeader(rw.Header(), header)
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", r.start, r.end, size))
+	rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	rw.WriteHeader(http.StatusPartialContent)
+	rw.Write(b)
+}
+
+func serveRange(o *options, cache *Cache, p *rox.Rox, rw http.ResponseWriter, out *http.Request, r byteRange) {
+	if sr := cache.Segments(out); sr != nil {
+		if b, served, header, size, ok := sr.Get(r, time.Now()); ok {
+			writeSegment(rw, header, size, served, b)
+			maybeLog(o, out)
+			return
+		}
+	}
+
+	res, err := rox.DoRequest(p, tieredRequest(o, out, false))
+	maybeLog(o, out)
+
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the origin ignored the range or sent something we
+	// can't place, so just hand it straight back
+	seg, size, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if res.StatusCode != http.StatusPartialContent || !ok {
+		writeResponse(rw, res)
+		return
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to read range response: %s", err))
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	// held to the same rules as a whole response would be
+	cr := &CachedResponse{Header: res.Header, StatusCode: res.StatusCode, Body: body}
+	cr.expire(responseCacheControl(res), o.StatusTTL.ttl(res.StatusCode, *o.TTL))
+
+	if int64(len(body)) == seg.end-seg.start+1 && cr.Fresh(time.Now()) && storable(o, out, cr, res) {
+		cache.StoreSegment(out, cr.Header, seg, size, body, cr.Expires)
+	}
+
+	if *o.PrefetchFullOnRange {
+		prefetchFull(o, cache, p, out)
+	}
+
+	rox.CopyHeader(rw.Header(), res.Header)
+	rw.WriteHeader(res.StatusCode)
+	rw.Write(body)
+}
+
+// the origin takes ranges, so a full request for the same
+// object is likely to follow. fetch the whole of it in the
+// background so that one is a hit
+func prefetchFull(o *options, cache *Cache, p *rox.Rox, out *http.Request) {
+	bg := out.Clone(context.Background())
+	bg.Header.Del("Range")
+	bg.Header.Del("If-Range")
+
+	cache.refresher.submit(func() { fetchFull(o, cache, p, bg) })
+}
+
+func fetchFull(o *options, cache *Cache, p *rox.Rox, bg *http.Request) {
+	ctx, cancel := context.WithCancel(bg.Context())
+	defer cancel()
+	bg = bg.WithContext(ctx)
+
+	// full requests arriving meanwhile wait on this fill
+	cr := cache.CreateMissing(bg, cancel, time.Now())
+	if cr == nil {
+		return
+	}
+	defer cr.completeUpdate()
+
+	res, err := rox.DoRequest(p, tieredRequest(o, bg, false))
+	maybeLog(o, bg)
+
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to prefetch %s: %s", bg.URL, err))
+		cache.Remove(bg, cr)
+		return
+	}
+
+	if res.StatusCode != http.StatusOK || !fill(o, bg, cr, res) {
+		cache.Remove(bg, cr)
+		return
+	}
+
+	cache.Account(bg, cr)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var rangeObject = func() []byte {
+	b := make([]byte, 10000)
+	for i := range b {
+		b[i] = byte('a' + i%26)
+	}
+	return b
+}()
+
+func rangeOrigin(t *testing.T, cacheControl string) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", cacheControl)
+		rw.Header().Set("Content-Type", "video/mp4")
+		rw.Header().Set("ETag", `"v1"`)
+		http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(rangeObject))
+	})
+}
+
+func heldSegments(c *Cache) int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	n := 0
+	for _, sr := range c.segments {
+		sr.lk.Lock()
+		n += len(sr.Segments)
+		sr.lk.Unlock()
+	}
+
+	return n
+}
+
+func getRange(t *testing.T, u string, start int, end int) *http.Response {
+	t.Helper()
+
+	res, body := get(t, u, "Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatal(fmt.Sprintf("bytes=%d-%d got %d, want 206", start, end, res.StatusCode))
+	}
+
+	if body != string(rangeObject[start:end+1]) {
+		t.Fatal(fmt.Sprintf("bytes=%d-%d got the wrong bytes", start, end))
+	}
+
+	if want := fmt.Sprintf("bytes %d-%d/%d", start, end, len(rangeObject)); res.Header.Get("Content-Range") != want {
+		t.Fatal(fmt.Sprintf("Content-Range %q, want %q", res.Header.Get("Content-Range"), want))
+	}
+
+	return res
+}
+
+func TestRangesAreServedFromStoredSegments(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges")
+
+	getRange(t, base+"/video.mp4", 0, 999)
+	getRange(t, base+"/video.mp4", 5000, 5999)
+
+	if n := heldSegments(cache); n != 2 {
+		t.Fatal(fmt.Sprintf("%d segments held after two disjoint ranges, want 2", n))
+	}
+
+	// inside the second segment
+	getRange(t, base+"/video.mp4", 5100, 5199)
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+
+	// straddles both, so not something we have
+	getRange(t, base+"/video.mp4", 900, 5099)
+	if n := origin.requests.Load(); n != 3 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 3", n))
+	}
+}
+
+func TestRangesPastTheEndGoToTheOrigin(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, _ := newProxy(t, origin.URL, "-c", "-cache-ranges")
+
+	getRange(t, base+"/video.mp4", 9000, 9999)
+
+	// runs past the end, so is cut short to what we have
+	res, body := get(t, base+"/video.mp4", "Range", "bytes=9500-10500")
+	if res.StatusCode != http.StatusPartialContent || body != string(rangeObject[9500:]) ||
+		res.Header.Get("Content-Range") != "bytes 9500-9999/10000" {
+		t.Fatal(fmt.Sprintf("got %d with Content-Range %q", res.StatusCode, res.Header.Get("Content-Range")))
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+
+	for _, r := range []string{"bytes=10000-10500", "bytes=10200-10500"} {
+		if res, _ := get(t, base+"/video.mp4", "Range", r); res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatal(fmt.Sprintf("%s got %d, want the origin's 416", r, res.StatusCode))
+		}
+	}
+}
+
+func TestSegmentsDontServePastTheEnd(t *testing.T) {
+	sr := &SegmentedResponse{Segments: make(map[byteRange]*segment)}
+	sr.Set(http.Header{}, byteRange{0, 999}, 1000, rangeObject[:1000], time.Time{}, time.Now())
+
+	for _, r := range []byteRange{{1000, 1500}, {1200, 1500}} {
+		if _, _, _, _, ok := sr.Get(r, time.Now()); ok {
+			t.Fatal(fmt.Sprintf("bytes=%d-%d of a 1000 byte object was served", r.start, r.end))
+		}
+	}
+}
+
+func TestRangesOnlyStoreCacheableResponses(t *testing.T) {
+	origin := rangeOrigin(t, "private, max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges")
+
+	getRange(t, base+"/video.mp4", 0, 999)
+	getRange(t, base+"/video.mp4", 0, 999)
+
+	if n := heldSegments(cache); n != 0 {
+		t.Fatal(fmt.Sprintf("%d segments held of a private response", n))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestRangesSkipAuthorizedRequests(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges", "-bypass-authorized")
+
+	getRange(t, base+"/video.mp4", 0, 999)
+	get(t, base+"/video.mp4", "Range", "bytes=0-99", "Authorization", "Bearer secret")
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("authorized range was served from segments, origin saw %d requests", n))
+	}
+
+	if n := heldSegments(cache); n != 1 {
+		t.Fatal(fmt.Sprintf("%d segments held, want only the public one", n))
+	}
+}
+
+func TestRangeSegmentsAreInvalidated(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges")
+
+	getRange(t, base+"/video.mp4", 0, 999)
+	request(t, "POST", base+"/video.mp4")
+
+	if n := heldSegments(cache); n != 0 {
+		t.Fatal(fmt.Sprintf("%d segments still held after a POST", n))
+	}
+}
+
+func TestRangeSegmentsCountTowardsTheirPool(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges", "-cache-pools", "/media=1:0")
+
+	getRange(t, base+"/media/a.mp4", 0, 999)
+	getRange(t, base+"/media/b.mp4", 0, 999)
+
+	cache.lk.Lock()
+	held := len(cache.segments)
+	cache.lk.Unlock()
+
+	if held != 1 {
+		t.Fatal(fmt.Sprintf("%d objects with segments in a pool of one", held))
+	}
+}
+
+func TestRangePrefetchesTheFullObject(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges", "-prefetch-full-on-range")
+
+	getRange(t, base+"/video", 0, 99)
+
+	waitFor(t, "the full object to be prefetched", 5*time.Second, func() bool {
+		return cachedEntry(t, cache, "/video") != nil
+	})
+
+	res, body := get(t, base+"/video")
+	if res.StatusCode != http.StatusOK || body != string(rangeObject) {
+		t.Fatal(fmt.Sprintf("full request got %d with %d bytes", res.StatusCode, len(body)))
+	}
+
+	// the range and the prefetch, the full request a hit
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestRangeDoesNotPrefetchByDefault(t *testing.T) {
+	origin := rangeOrigin(t, "max-age=60")
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-ranges")
+
+	getRange(t, base+"/video", 0, 99)
+	time.Sleep(50 * time.Millisecond)
+
+	if cachedEntry(t, cache, "/video") != nil || origin.requests.Load() != 1 {
+		t.Fatal("the full object was fetched without -prefetch-full-on-range")
+	}
+}
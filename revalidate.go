@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// asks the origin whether what we hold is still good, so
+// it can answer 304 rather than send the body again. a
+// client's own conditions are left alone, the answer to
+// those is theirs rather than ours
+func conditional(out *http.Request, stale *CachedResponse) bool {
+	if out.Method != "GET" || out.Header.Get("If-None-Match") != "" || out.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+
+	etag := stale.Header.Get("ETag")
+	modified := stale.Header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		return false
+	}
+
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+
+	if modified != "" {
+		out.Header.Set("If-Modified-Since", modified)
+	}
+
+	return true
+}
+
+// describe the body, which a 304 doesn't carry
+var bodyHeaders = []string{"Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range"}
+
+// fills cr from stale with the headers of the origin's
+// 304, which is as good as having fetched it again. stale
+// may still be being served, its header is copied rather
+// than updated and the bodies shared as they're never
+// written to once stored
+func revalidate(o *options, cr *CachedResponse, stale *CachedResponse, res *http.Response) {
+	header := stale.Header.Clone()
+	for name, values := range res.Header {
+		header[name] = values
+	}
+
+	for _, name := range bodyHeaders {
+		header.Del(name)
+		if v := stale.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+
+	cr.Header = header
+	cr.StatusCode = stale.StatusCode
+	cr.Body = stale.Body
+	cr.Gzip = stale.Gzip
+	cr.compressed = stale.compressed
+	cr.atRest = stale.atRest
+	cr.length = stale.length
+	cr.hasChecksum = stale.hasChecksum
+	cr.checksum = stale.checksum
+	cr.gzipChecksum = stale.gzipChecksum
+
+	cr.expire(parseCacheControl(strings.Join(header.Values("Cache-Control"), ",")), o.StatusTTL.ttl(cr.StatusCode, *o.TTL))
+	throttleRevalidation(o, cr)
+}
+
+func throttleRevalidation(o *options, cr *CachedResponse) {
+	if cr.noCache && *o.MinRevalidateInterval > 0 {
+		cr.Expires = cr.Stored.Add(*o.MinRevalidateInterval)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// always revalidate, answering a matching ETag with a 304
+func noCacheOrigin(t *testing.T, revalidations *atomic.Int64) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations.Add(1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(rw, "body")
+	})
+}
+
+func TestNoCacheRevalidatesAtMostOncePerInterval(t *testing.T) {
+	var revalidations atomic.Int64
+	origin := noCacheOrigin(t, &revalidations)
+	base, cache := newProxy(t, origin.URL, "-c", "-min-revalidate-interval", "5s")
+
+	for i := 0; i < 5; i++ {
+		if _, body := get(t, base+"/a"); body != "body" {
+			t.Fatal(fmt.Sprintf("got %q", body))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests within the interval, want 1", n))
+	}
+
+	age(t, cache, "/a", 6*time.Second)
+	for i := 0; i < 5; i++ {
+		if _, body := get(t, base+"/a"); body != "body" {
+			t.Fatal(fmt.Sprintf("got %q", body))
+		}
+	}
+
+	if n := revalidations.Load(); n != 1 || origin.requests.Load() != 2 {
+		t.Fatal(fmt.Sprintf("%d revalidations after the interval, want 1", n))
+	}
+}
+
+func TestNoCacheRevalidatesEveryRequestByDefault(t *testing.T) {
+	var revalidations atomic.Int64
+	origin := noCacheOrigin(t, &revalidations)
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	for i := 0; i < 5; i++ {
+		get(t, base+"/a")
+	}
+
+	if n := revalidations.Load(); n != 4 {
+		t.Fatal(fmt.Sprintf("%d revalidations, want one for each request after the first", n))
+	}
+}
+
+// every response is expired as soon as it's stored. a
+// revalidation of the current version gets a 304 every
+// other time and a new version otherwise, each body made
+// only of its version so a torn one stands out
+func changingOrigin(t *testing.T, cacheControl string) *testOrigin {
+	var lk sync.Mutex
+	version, asked := 1, 0
+
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		lk.Lock()
+		asked++
+		if r.Header.Get("If-None-Match") != fmt.Sprintf(`"%d"`, version) || asked%2 == 0 {
+			version++
+		}
+		v := version
+		lk.Unlock()
+
+		rw.Header().Set("Cache-Control", cacheControl)
+		rw.Header().Set("ETag", fmt.Sprintf(`"%d"`, v))
+		rw.Header().Set("X-Version", strconv.Itoa(v))
+		if r.Header.Get("If-None-Match") == fmt.Sprintf(`"%d"`, v) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		io.WriteString(rw, versionBody(v))
+	})
+}
+
+func versionBody(v int) string {
+	return strings.Repeat(fmt.Sprintf("v%d;", v), 8<<10)
+}
+
+// run with -race, readers of an entry being refreshed
+// under them must each see one whole version of it
+func TestConcurrentReadsDuringRefreshAreNotTorn(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		cacheControl string
+	}{
+		// served stale while refreshed in the background
+		{"background", "max-age=0, stale-while-revalidate=60"},
+		// revalidated in the foreground, readers wait on it
+		{"foreground", "max-age=0"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			origin := changingOrigin(t, c.cacheControl)
+			base, _ := newProxy(t, origin.URL, "-c")
+			get(t, base+"/a")
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			deadline := time.Now().Add(300 * time.Millisecond)
+
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					for time.Now().Before(deadline) {
+						req, _ := http.NewRequest("GET", base+"/a", nil)
+						res, err := testTransport.RoundTrip(req)
+						if err != nil {
+							errs <- err
+							return
+						}
+
+						body, err := io.ReadAll(res.Body)
+						res.Body.Close()
+						if err != nil {
+							errs <- err
+							return
+						}
+
+						v, _ := strconv.Atoi(res.Header.Get("X-Version"))
+						if res.StatusCode != http.StatusOK || string(body) != versionBody(v) ||
+							res.Header.Get("ETag") != fmt.Sprintf(`"%d"`, v) ||
+							res.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+							errs <- errors.New(fmt.Sprintf("got %d with X-Version %q, ETag %q and Content-Length %q over %d bytes not all of that version",
+								res.StatusCode, res.Header.Get("X-Version"), res.Header.Get("ETag"), res.Header.Get("Content-Length"), len(body)))
+							return
+						}
+					}
+				}()
+			}
+
+			wg.Wait()
+			close(errs)
+
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if n := origin.requests.Load(); n < 3 {
+				t.Fatal(fmt.Sprintf("origin saw %d requests, the entry was hardly refreshed", n))
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// -cache-routes /static=on,/api=off turns caching on or
+// off under a path prefix whatever -c says, which is left
+// to decide for everything not listed
+type cacheRoutes map[string]bool
+
+func (rt cacheRoutes) String() string {
+	var s []string
+	for prefix, on := range rt {
+		state := "off"
+		if on {
+			state = "on"
+		}
+
+		s = append(s, prefix+"="+state)
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (rt cacheRoutes) Set(v string) error {
+	for _, route := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(route), "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return errors.New(fmt.Sprintf("invalid cache route %q", route))
+		}
+
+		switch parts[1] {
+		case "on":
+			rt[parts[0]] = true
+		case "off":
+			rt[parts[0]] = false
+		default:
+			return errors.New(fmt.Sprintf("invalid cache route state %q, must be on or off", parts[1]))
+		}
+	}
+
+	return nil
+}
+
+// the longest matching prefix decides
+func (rt cacheRoutes) caches(path string, fallback bool) bool {
+	var match string
+	on := fallback
+
+	for prefix, state := range rt {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(match) {
+			match, on = prefix, state
+		}
+	}
+
+	return on
+}
+
+func (rt cacheRoutes) any() bool {
+	for _, on := range rt {
+		if on {
+			return true
+		}
+	}
+
+	return false
+}
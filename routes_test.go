@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func cacheableOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+	})
+}
+
+// how many of two GETs for path reached the origin
+func originRequests(t *testing.T, base string, origin *testOrigin, path string) int64 {
+	before := origin.requests.Load()
+	get(t, base+path)
+	get(t, base+path)
+
+	return origin.requests.Load() - before
+}
+
+func TestRouteCachedWithCacheOffGlobally(t *testing.T) {
+	origin := cacheableOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-cache-routes", "/static=on")
+
+	if n := originRequests(t, base, origin, "/static/app.js"); n != 1 {
+		t.Fatal(fmt.Sprintf("/static reached the origin %d times, want it cached", n))
+	}
+
+	for _, path := range []string{"/", "/api/users"} {
+		if n := originRequests(t, base, origin, path); n != 2 {
+			t.Fatal(fmt.Sprintf("%s reached the origin %d times, want it passed through", path, n))
+		}
+	}
+}
+
+func TestRouteNotCachedWithCacheOnGlobally(t *testing.T) {
+	origin := cacheableOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-cache-routes", "/api=off,/api/static=on")
+
+	for path, want := range map[string]int64{
+		"/":              1,
+		"/api/users":     2,
+		"/api/static/js": 1,
+	} {
+		if n := originRequests(t, base, origin, path); n != want {
+			t.Fatal(fmt.Sprintf("%s reached the origin %d times, want %d", path, n, want))
+		}
+	}
+}
+
+func TestCacheRoutesRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"static=on", "/static", "/static=yes", "/a=on,b=off"} {
+		if err := make(cacheRoutes).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// distinct URLs the self-test asks for, a few are asked
+// for far more often than the rest as real traffic would
+const selftestURLs = 1000
+
+var selftestBody = bytes.Repeat([]byte("selftest "), 512)
+
+// -selftest puts the proxy, as configured by every other
+// flag, in front of an origin of its own and sends it
+// traffic, then writes how it did to report. the target
+// and -address are ignored
+func runSelftest(o *options, report io.Writer, requests int, concurrency int) {
+	if requests < 1 {
+		requests = 1
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var originRequests atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		originRequests.Add(1)
+
+		// something for the cache to save
+		time.Sleep(time.Millisecond)
+
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(selftestBody)))
+		rw.Write(selftestBody)
+	}))
+	defer origin.Close()
+
+	target, err := url.Parse(origin.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	o.Target = target
+	o.Address = "127.0.0.1:0"
+
+	handler, cache := newProxyHandler(o)
+	ln := listen(o)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	base := "http://" + ln.Addr().String()
+
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, selftestURLs-1)
+	paths := make([]string, requests)
+	for i := range paths {
+		paths[i] = base + "/selftest/" + strconv.FormatUint(zipf.Uint64(), 10)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: concurrency},
+		Timeout:   30 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	latencies := make([]time.Duration, requests)
+	var failed atomic.Int64
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				sent := time.Now()
+				res, err := client.Get(paths[i])
+				if err == nil {
+					io.Copy(io.Discard, res.Body)
+					res.Body.Close()
+				}
+				latencies[i] = time.Since(sent)
+
+				if err != nil || res.StatusCode != http.StatusOK {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	percentile := func(p float64) time.Duration {
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+
+	fmt.Fprintln(report, fmt.Sprintf("requests:  %d over %d urls, %d at a time, in %s (%.0f/s)",
+		requests, selftestURLs, concurrency, elapsed.Round(time.Millisecond), float64(requests)/elapsed.Seconds()))
+	fmt.Fprintln(report, fmt.Sprintf("errors:    %d", failed.Load()))
+	fmt.Fprintln(report, fmt.Sprintf("origin:    %d requests", originRequests.Load()))
+
+	if cache != nil {
+		hits, misses := cache.stats.hits.Load(), cache.stats.misses.Load()
+		ratio := float64(0)
+		if hits+misses > 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+
+		entries, size := cache.usage()
+		fmt.Fprintln(report, fmt.Sprintf("cache:     %d hits, %d misses, hit ratio %.3f, %d entries in %s", hits, misses, ratio, entries, megabytes(uint64(size))))
+	} else {
+		fmt.Fprintln(report, "cache:     off")
+	}
+
+	fmt.Fprintln(report, fmt.Sprintf("latency:   p50 %s  p90 %s  p99 %s  max %s",
+		percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1]))
+	fmt.Fprintln(report, fmt.Sprintf("memory:    heap %s, %s allocated during the run",
+		megabytes(after.HeapAlloc), megabytes(after.TotalAlloc-before.TotalAlloc)))
+}
+
+func megabytes(n uint64) string {
+	return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSelftestReports(t *testing.T) {
+	for _, c := range []struct {
+		args  []string
+		cache string
+	}{
+		{[]string{"-c"}, "hit ratio"},
+		{nil, "cache:     off"},
+	} {
+		var report bytes.Buffer
+		runSelftest(testOptions(t, "", c.args...), &report, 200, 4)
+
+		for _, want := range []string{
+			"requests:  200 over",
+			"errors:    0",
+			"origin:    ",
+			c.cache,
+			"latency:   p50",
+			"memory:    heap",
+		} {
+			if !strings.Contains(report.String(), want) {
+				t.Fatal(fmt.Sprintf("report with %v has no %q:\n%s", c.args, want, report.String()))
+			}
+		}
+	}
+}
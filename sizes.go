@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a max of 0 is unbounded
+type sizeRange struct {
+	min int
+	max int
+}
+
+func (sr sizeRange) String() string {
+	s := strconv.Itoa(sr.min) + "-"
+	if sr.max > 0 {
+		s += strconv.Itoa(sr.max)
+	}
+
+	return s
+}
+
+func (sr sizeRange) allows(size int) bool {
+	return size >= sr.min && (sr.max <= 0 || size <= sr.max)
+}
+
+// repeatable -cache-size-range min-max, or /prefix=min-max
+// for a single route, in bytes with either end left off
+// if it's open. bodies outside the range are served but
+// not cached, a 1 byte body costs as much to look up as
+// it does to fetch and a huge one pushes out many others
+type sizeRanges map[string]sizeRange
+
+func (s sizeRanges) String() string {
+	var rules []string
+	for prefix, sr := range s {
+		if prefix == "" {
+			rules = append(rules, sr.String())
+		} else {
+			rules = append(rules, prefix+"="+sr.String())
+		}
+	}
+
+	sort.Strings(rules)
+	return strings.Join(rules, ",")
+}
+
+func (s sizeRanges) Set(v string) error {
+	var prefix string
+	bounds := v
+
+	if strings.HasPrefix(v, "/") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return errors.New(fmt.Sprintf("invalid cache size range %q, must be min-max or /prefix=min-max", v))
+		}
+
+		prefix, bounds = parts[0], parts[1]
+	}
+
+	parts := strings.SplitN(bounds, "-", 2)
+	if len(parts) != 2 {
+		return errors.New(fmt.Sprintf("invalid cache size range %q, must be min-max or /prefix=min-max", v))
+	}
+
+	var sr sizeRange
+	var err error
+
+	if parts[0] != "" {
+		if sr.min, err = strconv.Atoi(parts[0]); err != nil || sr.min < 0 {
+			return errors.New(fmt.Sprintf("invalid cache size range minimum %q", parts[0]))
+		}
+	}
+
+	if parts[1] != "" {
+		if sr.max, err = strconv.Atoi(parts[1]); err != nil || sr.max <= 0 || sr.max < sr.min {
+			return errors.New(fmt.Sprintf("invalid cache size range maximum %q", parts[1]))
+		}
+	}
+
+	s[prefix] = sr
+	return nil
+}
+
+// the longest matching prefix decides, the range without
+// one covers everything else
+func (s sizeRanges) allows(path string, size int) bool {
+	var match string
+	sr, ok := s[""]
+
+	for prefix, r := range s {
+		if prefix != "" && strings.HasPrefix(path, prefix) && len(prefix) > len(match) {
+			match, sr, ok = prefix, r, true
+		}
+	}
+
+	return !ok || sr.allows(size)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serves a body of ?size= bytes
+func sizedOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte(strings.Repeat("x", size)))
+	})
+}
+
+func TestOnlyBodiesInTheSizeRangeAreCached(t *testing.T) {
+	origin := sizedOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c",
+		"-cache-size-range", "10-1000",
+		"-cache-size-range", "/big=1000-")
+
+	for _, c := range []struct {
+		path   string
+		size   int
+		cached bool
+	}{
+		{"/small", 1, false},
+		{"/small", 9, false},
+		{"/fits", 10, true},
+		{"/fits", 1000, true},
+		{"/large", 1001, false},
+		{"/large", 100000, false},
+		// the route's own range in place of the global one
+		{"/big", 10, false},
+		{"/big", 100000, true},
+	} {
+		u := fmt.Sprintf("%s/%d?size=%d", base+c.path, c.size, c.size)
+		before := origin.requests.Load()
+
+		for i := 0; i < 2; i++ {
+			if _, body := get(t, u); len(body) != c.size {
+				t.Fatal(fmt.Sprintf("%s got %d bytes, want %d", c.path, len(body), c.size))
+			}
+		}
+
+		want := int64(2)
+		if c.cached {
+			want = 1
+		}
+
+		if n := origin.requests.Load() - before; n != want {
+			t.Fatal(fmt.Sprintf("%d bytes under %s reached the origin %d times, want %d", c.size, c.path, n, want))
+		}
+	}
+}
+
+func TestCacheSizeRangeRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "10", "a-b", "-1-10", "10-5", "10-0", "/big", "/big=10"} {
+		if err := make(sizeRanges).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// redirects to one canonical form of each path so the
+// same page isn't cached (and indexed) twice
+func canonicalSlash(mode string, next http.Handler) (http.Handler, error) {
+	if mode != "add" && mode != "strip" {
+		return nil, errors.New("trailing slash mode must be add or strip")
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p := r.URL.EscapedPath()
+
+		// redirecting anything else would change its method
+		if (r.Method != "GET" && r.Method != "HEAD") || p == "/" || p == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		canonical := p
+		switch {
+		case mode == "strip" && strings.HasSuffix(p, "/"):
+			canonical = strings.TrimRight(p, "/")
+			if canonical == "" {
+				canonical = "/"
+			}
+		// /app.js is a file, not a directory
+		case mode == "add" && !strings.HasSuffix(p, "/") && !strings.Contains(path.Base(p), "."):
+			canonical = p + "/"
+		}
+
+		if canonical == p {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		// //evil.example/x would send the browser to another
+		// host, and being a 301 it would remember to
+		canonical = "/" + strings.TrimLeft(canonical, "/")
+
+		if r.URL.RawQuery != "" {
+			canonical += "?" + r.URL.RawQuery
+		}
+
+		rw.Header().Set("Location", canonical)
+		rw.WriteHeader(http.StatusMovedPermanently)
+	}), nil
+}
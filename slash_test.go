@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func slashOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, r.URL.Path)
+	})
+}
+
+func TestTrailingSlashRedirects(t *testing.T) {
+	origin := slashOrigin(t)
+
+	for _, c := range []struct {
+		mode     string
+		path     string
+		location string
+	}{
+		{"add", "/about", "/about/"},
+		{"add", "/about?x=1", "/about/?x=1"},
+		{"add", "/a%2Fb", "/a%2Fb/"},
+		{"strip", "/about/", "/about"},
+		{"strip", "/about//?x=1", "/about?x=1"},
+		// not to another host
+		{"add", "//evil.example/x", "/evil.example/x/"},
+		{"strip", "//evil.example//", "/evil.example"},
+		{"strip", "///", "/"},
+	} {
+		base, _ := newProxy(t, origin.URL, "-trailing-slash", c.mode)
+
+		res := rawRequest(t, base, "GET "+c.path+" HTTP/1.1\r\nHost: proxy\r\n\r\n")
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusMovedPermanently {
+			t.Fatal(fmt.Sprintf("%s %s got %d, want 301", c.mode, c.path, res.StatusCode))
+		}
+
+		if loc := res.Header.Get("Location"); loc != c.location {
+			t.Fatal(fmt.Sprintf("%s %s redirected to %q, want %q", c.mode, c.path, loc, c.location))
+		}
+
+		if strings.HasPrefix(res.Header.Get("Location"), "//") {
+			t.Fatal("redirected off the host")
+		}
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests for paths that were redirected", n))
+	}
+}
+
+func TestTrailingSlashLeavesCanonicalPathsAlone(t *testing.T) {
+	origin := slashOrigin(t)
+
+	for _, c := range []struct {
+		mode   string
+		method string
+		path   string
+	}{
+		{"add", "GET", "/about/"},
+		{"add", "GET", "/app.js"},
+		{"add", "GET", "/"},
+		{"add", "POST", "/about"},
+		{"strip", "GET", "/about"},
+		{"strip", "GET", "/"},
+		{"strip", "PUT", "/about/"},
+	} {
+		base, _ := newProxy(t, origin.URL, "-trailing-slash", c.mode)
+
+		res, body := request(t, c.method, base+c.path)
+		if res.StatusCode != http.StatusOK || body != c.path {
+			t.Fatal(fmt.Sprintf("%s %s %s got %d %q, want it passed through", c.mode, c.method, c.path, res.StatusCode, body))
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sonewman/rox"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	warnStale            = `110 - "Response is Stale"`
+	warnRevalidateFailed = `111 - "Revalidation Failed"`
+)
+
+// the origin can widen the configured window per response
+func staleWindow(configured time.Duration, directive time.Duration) time.Duration {
+	if directive > configured {
+		return directive
+	}
+
+	return configured
+}
+
+// a copy of cr marked up so browsers and CDNs further down
+// know they've been given stale content, and for how much
+// longer they may do the same
+func (cr *CachedResponse) stale(now time.Time, warning string, window time.Duration) *CachedResponse {
+	header := make(http.Header)
+	rox.CopyHeader(header, cr.Header)
+
+	header.Set("Age", strconv.FormatInt(int64(now.Sub(cr.Stored)/time.Second), 10))
+	header.Add("Warning", warning)
+
+	if window > 0 {
+		cc := parseCacheControl(strings.Join(header.Values("Cache-Control"), ","))
+		if _, ok := cc["stale-while-revalidate"]; !ok {
+			header.Add("Cache-Control", fmt.Sprintf("stale-while-revalidate=%d", int64(window/time.Second)))
+		}
+	}
+
+	return &CachedResponse{
+		Header:     header,
+		StatusCode: cr.StatusCode,
+		Body:       cr.Body,
+		Gzip:       cr.Gzip,
+		compressed: cr.compressed,
+		atRest:     cr.atRest,
+		length:     cr.length,
+		Stored:     cr.Stored,
+		Expires:    cr.Expires,
+
+		hasChecksum:  cr.hasChecksum,
+		checksum:     cr.checksum,
+		gzipChecksum: cr.gzipChecksum,
+	}
+}
+
+// bounds how many refreshes run at once so background
+// work can't pile onto an origin that is already slow,
+// anything beyond what the queue holds is dropped
+type refresher struct {
+	jobs chan func()
+}
+
+func newRefresher(workers int) *refresher {
+	if workers < 1 {
+		workers = 1
+	}
+
+	r := &refresher{jobs: make(chan func(), workers)}
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+
+	return r
+}
+
+func (r *refresher) work() {
+	for job := range r.jobs {
+		job()
+	}
+}
+
+func (r *refresher) submit(job func()) bool {
+	select {
+	case r.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// queues a refresh of old unless one is already underway
+func startRefresh(o *options, cache *Cache, p *rox.Rox, out *http.Request, old *CachedResponse) {
+	if !old.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+
+	// detached from the client, who won't wait for it
+	bg := out.Clone(context.Background())
+
+	if !cache.refresher.submit(func() { refresh(o, cache, p, bg, old) }) {
+		old.refreshing.Store(false)
+	}
+}
+
+// fetches a replacement for old outside of any client
+// request, old keeps being served until it is swapped. an
+// old entry with a validator is only revalidated, which is
+// what -hot-origin is for, otherwise it's a fetch from
+// scratch like any miss
+func refresh(o *options, cache *Cache, p *rox.Rox, bg *http.Request, old *CachedResponse) {
+	defer old.refreshing.Store(false)
+
+	revalidating := conditional(bg, old)
+
+	res, err := rox.DoRequest(p, tieredRequest(o, bg, revalidating))
+	maybeLog(o, bg)
+
+	if err == nil && res.StatusCode == http.StatusNotFound {
+		res = tryFallback(o, p, bg, res)
+	}
+
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to refresh %s: %s", bg.URL, err))
+		return
+	}
+
+	if res.StatusCode >= 500 {
+		log.Println(fmt.Sprintf("failed to refresh %s: origin returned %d", bg.URL, res.StatusCode))
+		return
+	}
+
+	cr := &CachedResponse{}
+	if revalidating && res.StatusCode == http.StatusNotModified {
+		revalidate(o, cr, old, res)
+		cache.Replace(bg, old, cr)
+		return
+	}
+
+	if fill(o, bg, cr, res) {
+		cache.Replace(bg, old, cr)
+	} else {
+		cache.Remove(bg, old)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidateIsMarkedStale(t *testing.T) {
+	var version atomic.Int64
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(rw, "v%d", version.Add(1))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-stale-while-revalidate", "30s")
+
+	get(t, base+"/a")
+	age(t, cache, "/a", 70*time.Second)
+
+	res, body := get(t, base+"/a")
+	if body != "v1" {
+		t.Fatal(fmt.Sprintf("got %s, want the stale v1", body))
+	}
+
+	if w := res.Header.Get("Warning"); !strings.HasPrefix(w, "110 ") {
+		t.Fatal(fmt.Sprintf("Warning %q, want 110", w))
+	}
+
+	if cc := strings.Join(res.Header.Values("Cache-Control"), ","); !strings.Contains(cc, "stale-while-revalidate=30") {
+		t.Fatal(fmt.Sprintf("Cache-Control %q doesn't pass on the window", cc))
+	}
+
+	if a, _ := strconv.Atoi(res.Header.Get("Age")); a < 70 {
+		t.Fatal(fmt.Sprintf("Age %q, want at least 70", res.Header.Get("Age")))
+	}
+
+	waitFor(t, "the background refresh", 5*time.Second, func() bool {
+		c := cachedEntry(t, cache, "/a")
+		return c != nil && c.Fresh(time.Now())
+	})
+
+	res, body = get(t, base+"/a")
+	if body != "v2" || res.Header.Get("Warning") != "" {
+		t.Fatal(fmt.Sprintf("got %s with Warning %q after the refresh, want a fresh v2", body, res.Header.Get("Warning")))
+	}
+}
+
+func TestStaleIfErrorIsMarkedStale(t *testing.T) {
+	var failing atomic.Bool
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("ok"))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-stale-if-error", "30s")
+
+	get(t, base+"/a")
+	age(t, cache, "/a", 70*time.Second)
+	failing.Store(true)
+
+	res, body := get(t, base+"/a")
+	if res.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the stale copy", res.StatusCode, body))
+	}
+
+	if w := res.Header.Get("Warning"); !strings.HasPrefix(w, "111 ") {
+		t.Fatal(fmt.Sprintf("Warning %q, want 111", w))
+	}
+
+	// past the window the error goes through
+	age(t, cache, "/a", time.Minute)
+	if res, _ := get(t, base+"/a"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Sprintf("got %d past the stale-if-error window, want 503", res.StatusCode))
+	}
+}
+
+func TestBackgroundRefreshesAreBounded(t *testing.T) {
+	const workers = 2
+
+	var refreshing atomic.Bool
+	var inFlight, most atomic.Int64
+	release := make(chan struct{})
+
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if refreshing.Load() {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+
+			for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+			}
+
+			<-release
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, r.URL.Path)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-stale-while-revalidate", "30s", "-refresh-workers", strconv.Itoa(workers))
+
+	const entries = 20
+	for i := 0; i < entries; i++ {
+		get(t, base+fmt.Sprintf("/%d", i))
+	}
+
+	for i := 0; i < entries; i++ {
+		age(t, cache, fmt.Sprintf("/%d", i), 70*time.Second)
+	}
+
+	refreshing.Store(true)
+	for i := 0; i < entries; i++ {
+		// stale, so served at once with a refresh behind it
+		get(t, base+fmt.Sprintf("/%d", i))
+	}
+
+	waitFor(t, "the workers to be busy", 5*time.Second, func() bool {
+		return inFlight.Load() == workers
+	})
+
+	// give anything unbounded the chance to show itself
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if n := most.Load(); n != workers {
+		t.Fatal(fmt.Sprintf("%d refreshes ran at once, want at most %d", n, workers))
+	}
+}
+
+// fails until healthy is set
+func failingOrigin(t *testing.T, healthy *atomic.Bool) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=60, stale-if-error=60")
+		if !healthy.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(rw, "down")
+			return
+		}
+		io.WriteString(rw, "up")
+	})
+}
+
+func TestErrorIsCachedBrieflyThenRetried(t *testing.T) {
+	var healthy atomic.Bool
+	origin := failingOrigin(t, &healthy)
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-errors-ttl", "5s")
+
+	for i := 0; i < 3; i++ {
+		if res, _ := get(t, base+"/a"); res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatal(fmt.Sprintf("got %d, want the cached 503", res.StatusCode))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the error absorbed", n))
+	}
+
+	// well short of the 60s the origin asked for
+	healthy.Store(true)
+	age(t, cache, "/a", 6*time.Second)
+
+	if res, body := get(t, base+"/a"); res.StatusCode != http.StatusOK || body != "up" {
+		t.Fatal(fmt.Sprintf("got %d %q after the error TTL, want it retried", res.StatusCode, body))
+	}
+}
+
+func TestCachedErrorIsNeverServedStale(t *testing.T) {
+	var healthy atomic.Bool
+	origin := failingOrigin(t, &healthy)
+	base, cache := newProxy(t, origin.URL, "-c", "-cache-errors-ttl", "5s",
+		"-stale-while-revalidate", "60s", "-stale-if-error", "60s")
+
+	get(t, base+"/a")
+	healthy.Store(true)
+	age(t, cache, "/a", 6*time.Second)
+
+	if res, body := get(t, base+"/a"); res.StatusCode != http.StatusOK || body != "up" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the expired error refetched in the foreground", res.StatusCode, body))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// statuses that may be cached without the origin saying
+// for how long, RFC 7231 6.1. anything else needs an
+// explicit lifetime, from the origin or -status-ttl
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 206: true,
+	300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true,
+	501: true,
+}
+
+// -cacheable-status 301=off,299=on decides for those
+// statuses in place of the rules above, off is never
+// cached whatever the origin says, on is cached like a
+// 200 would be
+type cacheableStatuses map[int]bool
+
+func (cs cacheableStatuses) String() string {
+	var codes []int
+	for code := range cs {
+		codes = append(codes, code)
+	}
+
+	sort.Ints(codes)
+
+	var pairs []string
+	for _, code := range codes {
+		state := "off"
+		if cs[code] {
+			state = "on"
+		}
+
+		pairs = append(pairs, fmt.Sprintf("%d=%s", code, state))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (cs cacheableStatuses) Set(v string) error {
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return errors.New(fmt.Sprintf("invalid cacheable status %q, must be status=on or status=off", pair))
+		}
+
+		code, err := strconv.Atoi(parts[0])
+		if err != nil || code < 100 || code > 599 {
+			return errors.New(fmt.Sprintf("invalid status code %q", parts[0]))
+		}
+
+		switch parts[1] {
+		case "on":
+			cs[code] = true
+		case "off":
+			cs[code] = false
+		default:
+			return errors.New(fmt.Sprintf("invalid cacheable status state %q, must be on or off", parts[1]))
+		}
+	}
+
+	return nil
+}
+
+func statusCacheable(o *options, res *http.Response) bool {
+	if on, ok := o.CacheableStatus[res.StatusCode]; ok {
+		return on
+	}
+
+	if heuristicStatuses[res.StatusCode] {
+		return true
+	}
+
+	// told how long to keep it, by us or by the origin
+	if _, ok := o.StatusTTL[res.StatusCode]; ok {
+		return true
+	}
+
+	if *o.CacheErrorsTTL > 0 && res.StatusCode >= 500 {
+		return true
+	}
+
+	cc := responseCacheControl(res)
+	if _, ok := directiveSeconds(cc, "s-maxage"); ok {
+		return true
+	}
+
+	if _, ok := directiveSeconds(cc, "max-age"); ok {
+		return true
+	}
+
+	return res.Header.Get("Expires") != ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// a 301 the origin says to keep for a minute, and a
+// custom 299 it says nothing about
+func statusOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("Location", "/new")
+			rw.WriteHeader(http.StatusMovedPermanently)
+		case "/custom":
+			rw.WriteHeader(299)
+		}
+	})
+}
+
+func cachedStatuses(t *testing.T, args ...string) map[string]bool {
+	origin := statusOrigin(t)
+	base, cache := newProxy(t, origin.URL, append([]string{"-c", "-ttl", "60"}, args...)...)
+
+	cached := make(map[string]bool)
+	for _, path := range []string{"/moved", "/custom"} {
+		get(t, base+path)
+		cached[path] = cachedEntry(t, cache, path) != nil
+	}
+
+	return cached
+}
+
+func TestCacheableStatusDefaults(t *testing.T) {
+	cached := cachedStatuses(t)
+	if !cached["/moved"] || cached["/custom"] {
+		t.Fatal(fmt.Sprintf("got %v, want only the 301 cached", cached))
+	}
+}
+
+func TestCacheableStatusOverrides(t *testing.T) {
+	cached := cachedStatuses(t, "-cacheable-status", "301=off,299=on")
+	if cached["/moved"] || !cached["/custom"] {
+		t.Fatal(fmt.Sprintf("got %v, want only the 299 cached", cached))
+	}
+}
+
+func TestCacheableStatusRoundTrips(t *testing.T) {
+	cs := cacheableStatuses{}
+	if err := cs.Set("301=off, 299=on"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := cs.String(); s != "299=on,301=off" {
+		t.Fatal(fmt.Sprintf("got %q", s))
+	}
+}
+
+func TestCacheableStatusRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"301", "abc=on", "99=on", "600=off", "301=yes", "301="} {
+		if err := (cacheableStatuses{}).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("-cacheable-status %q was accepted", v))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -status-ttl 200=300,301=86400,404=10 in seconds, used
+// in place of -ttl for responses with those statuses
+type statusTTLs map[int]int
+
+func (s statusTTLs) String() string {
+	var codes []int
+	for code := range s {
+		codes = append(codes, code)
+	}
+
+	sort.Ints(codes)
+
+	var pairs []string
+	for _, code := range codes {
+		pairs = append(pairs, fmt.Sprintf("%d=%d", code, s[code]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (s statusTTLs) Set(v string) error {
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return errors.New(fmt.Sprintf("invalid status TTL %q", pair))
+		}
+
+		code, err := strconv.Atoi(parts[0])
+		if err != nil || code < 100 || code > 599 {
+			return errors.New(fmt.Sprintf("invalid status code %q", parts[0]))
+		}
+
+		ttl, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid TTL %q", parts[1]))
+		}
+
+		s[code] = ttl
+	}
+
+	return nil
+}
+
+func (s statusTTLs) ttl(status int, fallback int) int {
+	if ttl, ok := s[status]; ok {
+		return ttl
+	}
+
+	return fallback
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatusTTLsPerStatus(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			rw.Header().Set("Location", "/new")
+			rw.WriteHeader(http.StatusMovedPermanently)
+		case "/headed":
+			rw.Header().Set("Cache-Control", "max-age=5")
+		}
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-ttl", "1", "-status-ttl", "301=3600,200=60")
+
+	for path, want := range map[string]time.Duration{
+		"/moved": time.Hour,
+		"/page":  time.Minute,
+		// the origin's say still comes first
+		"/headed": 5 * time.Second,
+	} {
+		get(t, base+path)
+
+		cr := cachedEntry(t, cache, path)
+		if cr == nil {
+			t.Fatal("nothing cached for " + path)
+		}
+
+		if ttl := cr.Expires.Sub(cr.Stored); ttl != want {
+			t.Fatal(fmt.Sprintf("%s (%d) has a TTL of %s, want %s", path, cr.StatusCode, ttl, want))
+		}
+	}
+}
+
+func TestStatusTTLsRejectsBadPairs(t *testing.T) {
+	for _, v := range []string{"301", "abc=60", "99=60", "600=60", "200=soon"} {
+		if err := (statusTTLs{}).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("-status-ttl %q was accepted", v))
+		}
+	}
+}
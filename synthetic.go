@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type syntheticResponse struct {
+	pattern string
+	status  int
+	body    []byte
+}
+
+// repeatable -synthetic /path=status:body answered here
+// without going near the origin. a pattern ending in * is
+// a prefix, and a body of @file is read from that file,
+// e.g. /admin*=403:Forbidden or /robots.txt=200:@robots.txt
+type syntheticResponses []syntheticResponse
+
+func (s *syntheticResponses) String() string {
+	var rules []string
+	for _, sr := range *s {
+		rules = append(rules, fmt.Sprintf("%s=%d", sr.pattern, sr.status))
+	}
+
+	return strings.Join(rules, ",")
+}
+
+func (s *syntheticResponses) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return errors.New(fmt.Sprintf("invalid synthetic response %q, must be /path=status:body", v))
+	}
+
+	res := strings.SplitN(parts[1], ":", 2)
+	status, err := strconv.Atoi(res[0])
+	if err != nil || status < 100 || status > 599 {
+		return errors.New(fmt.Sprintf("invalid synthetic response status %q", res[0]))
+	}
+
+	var body []byte
+	if len(res) == 2 {
+		body = []byte(res[1])
+		if strings.HasPrefix(res[1], "@") {
+			if body, err = os.ReadFile(res[1][1:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	*s = append(*s, syntheticResponse{parts[0], status, body})
+	return nil
+}
+
+func (sr syntheticResponse) matches(path string) bool {
+	return matchPath(sr.pattern, path)
+}
+
+// an exact path, or a prefix when pattern ends in *
+func matchPath(pattern string, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+
+	return path == pattern
+}
+
+// the first matching rule answers, ahead of the cache
+func serveSynthetic(rules syntheticResponses, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for _, sr := range rules {
+			if !sr.matches(r.URL.Path) {
+				continue
+			}
+
+			rw.Header().Set("Content-Type", http.DetectContentType(sr.body))
+			rw.Header().Set("Content-Length", strconv.Itoa(len(sr.body)))
+			rw.WriteHeader(sr.status)
+			if r.Method != "HEAD" {
+				rw.Write(sr.body)
+			}
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockedPathGetsTheSyntheticResponse(t *testing.T) {
+	robots := filepath.Join(t.TempDir(), "robots.txt")
+	if err := os.WriteFile(robots, []byte("User-agent: *\nDisallow: /\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "from the origin")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c",
+		"-synthetic", "/admin*=403:Forbidden",
+		"-synthetic", "/robots.txt=200:@"+robots)
+
+	for _, c := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/admin", http.StatusForbidden, "Forbidden"},
+		{"/admin/users?id=1", http.StatusForbidden, "Forbidden"},
+		{"/robots.txt", http.StatusOK, "User-agent: *\nDisallow: /\n"},
+	} {
+		res, body := get(t, base+c.path)
+		if res.StatusCode != c.status || body != c.body {
+			t.Fatal(fmt.Sprintf("%s got %d %q, want %d %q", c.path, res.StatusCode, body, c.status, c.body))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 0 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests for synthetic paths", n))
+	}
+
+	// only exact paths unless the pattern ends in *
+	if _, body := get(t, base+"/robots.txt.bak"); body != "from the origin" {
+		t.Fatal(fmt.Sprintf("/robots.txt.bak got %q", body))
+	}
+}
+
+func TestSyntheticRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "admin=403", "/admin", "/admin=forbidden", "/admin=999:x", "/robots.txt=200:@/does/not/exist"} {
+		var s syntheticResponses
+		if err := s.Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
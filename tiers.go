@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// an origin given as a flag, nil until it's set
+type originURL struct {
+	*url.URL
+}
+
+func (u *originURL) String() string {
+	if u.URL == nil {
+		return ""
+	}
+
+	return u.URL.String()
+}
+
+func (u *originURL) Set(v string) error {
+	parsed, err := url.Parse(v)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return errors.New(fmt.Sprintf("invalid origin URL %q", v))
+	}
+
+	u.URL = parsed
+	return nil
+}
+
+// tiered storage can make fetching something from scratch
+// and checking a copy we hold cost quite different amounts.
+// -cold-origin takes the misses and -hot-origin the
+// revalidations, the target whichever isn't set
+func tieredRequest(o *options, out *http.Request, revalidating bool) *http.Request {
+	origin := o.ColdOrigin.URL
+	if revalidating {
+		origin = o.HotOrigin.URL
+	}
+
+	if origin == nil {
+		return out
+	}
+
+	return toOrigin(o, out, origin)
+}
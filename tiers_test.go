@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// a tier of storage holding the same object, answering
+// revalidations with a 304
+func tierOrigin(t *testing.T, name string) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		io.WriteString(rw, name)
+	})
+}
+
+func TestMissesGoColdAndRevalidationsHot(t *testing.T) {
+	target := tierOrigin(t, "target")
+	cold := tierOrigin(t, "cold")
+	hot := tierOrigin(t, "hot")
+	base, cache := newProxy(t, target.URL, "-c", "-cold-origin", cold.URL, "-hot-origin", hot.URL)
+
+	if _, body := get(t, base+"/a"); body != "cold" {
+		t.Fatal(fmt.Sprintf("the miss got %q from the wrong origin", body))
+	}
+
+	age(t, cache, "/a", 70*time.Second)
+
+	res, body := get(t, base+"/a")
+	if res.StatusCode != http.StatusOK || body != "cold" {
+		t.Fatal(fmt.Sprintf("got %d %q, want the revalidated cold copy", res.StatusCode, body))
+	}
+
+	if n := hot.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("hot origin was asked %d times, want the one revalidation", n))
+	}
+
+	if n := cold.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("cold origin was asked %d times, want the one miss", n))
+	}
+
+	if n := target.requests.Load(); n != 0 {
+		t.Fatal(fmt.Sprintf("target was asked %d times", n))
+	}
+}
+
+func TestUnsetTierFallsBackToTheTarget(t *testing.T) {
+	target := tierOrigin(t, "target")
+	cold := tierOrigin(t, "cold")
+	base, cache := newProxy(t, target.URL, "-c", "-cold-origin", cold.URL)
+
+	get(t, base+"/a")
+	age(t, cache, "/a", 70*time.Second)
+	get(t, base+"/a")
+
+	if cold.requests.Load() != 1 || target.requests.Load() != 1 {
+		t.Fatal(fmt.Sprintf("cold asked %d times and target %d, want one each", cold.requests.Load(), target.requests.Load()))
+	}
+}
+
+func TestTierOriginRejectsBadValues(t *testing.T) {
+	for _, v := range []string{"", "example.com", "/path", "http://"} {
+		if err := new(originURL).Set(v); err == nil {
+			t.Fatal(fmt.Sprintf("%q was accepted", v))
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Server-Timing: cache;desc="miss";dur=0.042, origin;dur=118.250
+// for devtools to show where a request's time went. the
+// cache figure includes any wait on someone else's fill
+func setServerTiming(rw http.ResponseWriter, outcome string, lookup time.Duration, origin time.Duration) {
+	v := fmt.Sprintf("cache;desc=%q;dur=%.3f", outcome, ms(lookup))
+	if origin > 0 {
+		v += fmt.Sprintf(", origin;dur=%.3f", ms(origin))
+	}
+
+	rw.Header().Set("Server-Timing", v)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
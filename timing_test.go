@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metric name to its parameters, as in a Server-Timing
+// header
+func serverTimings(h string) map[string]map[string]string {
+	metrics := make(map[string]map[string]string)
+	for _, metric := range strings.Split(h, ",") {
+		parts := strings.Split(strings.TrimSpace(metric), ";")
+		params := make(map[string]string)
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) == 2 {
+				params[kv[0]] = strings.Trim(kv[1], `"`)
+			}
+		}
+
+		metrics[parts[0]] = params
+	}
+
+	return metrics
+}
+
+func TestServerTimingOnMissAndHit(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		rw.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-server-timing")
+
+	res, _ := get(t, base+"/a")
+	miss := serverTimings(res.Header.Get("Server-Timing"))
+
+	if miss["cache"]["desc"] != "miss" {
+		t.Fatal(fmt.Sprintf("miss has Server-Timing %q", res.Header.Get("Server-Timing")))
+	}
+
+	dur, err := strconv.ParseFloat(miss["origin"]["dur"], 64)
+	if err != nil || dur < 20 {
+		t.Fatal(fmt.Sprintf("origin took 20ms or more, Server-Timing %q", res.Header.Get("Server-Timing")))
+	}
+
+	res, _ = get(t, base+"/a")
+	hit := serverTimings(res.Header.Get("Server-Timing"))
+
+	if _, err := strconv.ParseFloat(hit["cache"]["dur"], 64); hit["cache"]["desc"] != "hit" || err != nil {
+		t.Fatal(fmt.Sprintf("hit has Server-Timing %q", res.Header.Get("Server-Timing")))
+	}
+
+	if _, ok := hit["origin"]; ok {
+		t.Fatal(fmt.Sprintf("hit has an origin timing, %q", res.Header.Get("Server-Timing")))
+	}
+}
+
+func TestNoServerTimingByDefault(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c")
+
+	for i := 0; i < 2; i++ {
+		if res, _ := get(t, base+"/a"); res.Header.Get("Server-Timing") != "" {
+			t.Fatal(fmt.Sprintf("got Server-Timing %q", res.Header.Get("Server-Timing")))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type bodyRewrite struct {
+	from []byte
+	to   []byte
+}
+
+// repeatable -rewrite-body from=>to
+type bodyRewrites []bodyRewrite
+
+func (r *bodyRewrites) String() string {
+	var s []string
+	for _, rw := range *r {
+		s = append(s, string(rw.from)+"=>"+string(rw.to))
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (r *bodyRewrites) Set(v string) error {
+	parts := strings.SplitN(v, "=>", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("body rewrite must be in the form from=>to")
+	}
+
+	*r = append(*r, bodyRewrite{[]byte(parts[0]), []byte(parts[1])})
+	return nil
+}
+
+func isTextual(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return strings.HasPrefix(ct, "text/") ||
+		strings.Contains(ct, "json") ||
+		strings.Contains(ct, "javascript") ||
+		strings.Contains(ct, "xml")
+}
+
+const warnTransformed = `214 - "Transformation Applied"`
+
+// the origin can forbid us changing what it sent at all
+func noTransform(h http.Header) bool {
+	cc := parseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	_, ok := cc["no-transform"]
+	return ok
+}
+
+func markTransformed(h http.Header) {
+	for _, w := range h.Values("Warning") {
+		if strings.HasPrefix(w, "214") {
+			return
+		}
+	}
+
+	h.Add("Warning", warnTransformed)
+}
+
+// validators that describe the bytes the origin sent
+// and would be lies once the body has been changed
+var contentValidators = []string{"ETag", "Content-MD5", "Digest"}
+
+// applies the configured rewrites to cr before it is
+// cached, reporting whether the body changed
+func transformBody(o *options, cr *CachedResponse) bool {
+	if len(*o.RewriteBody) == 0 || cr.Header.Get("Content-Encoding") != "" || !isTextual(cr.Header.Get("Content-Type")) {
+		return false
+	}
+
+	if noTransform(cr.Header) {
+		return false
+	}
+
+	body := cr.Body
+	for _, rw := range *o.RewriteBody {
+		body = bytes.Replace(body, rw.from, rw.to, -1)
+	}
+
+	if bytes.Equal(body, cr.Body) {
+		return false
+	}
+
+	cr.Body = body
+	cr.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	for _, h := range contentValidators {
+		cr.Header.Del(h)
+	}
+	markTransformed(cr.Header)
+
+	return true
+}
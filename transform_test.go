@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewrittenBodyGetsNewLengthAndNoValidators(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		body := `<a href="https://origin.internal/x">x</a>`
+		rw.Header().Set("Content-Type", "text/html")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		rw.Header().Set("ETag", `"abc"`)
+		rw.Header().Set("Content-MD5", "Q2hlY2sgSW50ZWdyaXR5IQ==")
+		if r.URL.Path == "/raw" {
+			rw.Header().Set("Cache-Control", "max-age=60, no-transform")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=60")
+		}
+		io.WriteString(rw, body)
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-rewrite-body", "origin.internal=>cdn.example.com")
+	want := `<a href="https://cdn.example.com/x">x</a>`
+
+	// the miss and the hit after it
+	for i := 0; i < 2; i++ {
+		res, body := get(t, base+"/page")
+		if body != want {
+			t.Fatal(fmt.Sprintf("got %q, want %q", body, want))
+		}
+
+		if res.ContentLength != int64(len(want)) {
+			t.Fatal(fmt.Sprintf("Content-Length %d, want %d", res.ContentLength, len(want)))
+		}
+
+		for _, h := range []string{"ETag", "Content-MD5"} {
+			if v := res.Header.Get(h); v != "" {
+				t.Fatal(fmt.Sprintf("%s %q describes the origin's body, not the one sent", h, v))
+			}
+		}
+	}
+
+	res, body := get(t, base+"/raw")
+	if body == want || res.Header.Get("ETag") != `"abc"` {
+		t.Fatal("a no-transform response was rewritten")
+	}
+}
+
+func hasTransformWarning(res *http.Response) bool {
+	for _, w := range res.Header.Values("Warning") {
+		if w == warnTransformed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestTransformWarningOnRewrittenBodies(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/html")
+		io.WriteString(rw, "<p>"+r.URL.Path+"</p>")
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-rewrite-body", "/changed=>/rewritten")
+
+	// the miss and the hit after it
+	for i := 0; i < 2; i++ {
+		if res, _ := get(t, base+"/changed"); !hasTransformWarning(res) {
+			t.Fatal(fmt.Sprintf("rewritten body has Warning %q", res.Header.Values("Warning")))
+		}
+
+		if res, _ := get(t, base+"/untouched"); len(res.Header.Values("Warning")) > 0 {
+			t.Fatal(fmt.Sprintf("untouched body has Warning %q", res.Header.Values("Warning")))
+		}
+	}
+}
+
+func TestTransformWarningOnlyOnCompressedCopies(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/raw" {
+			rw.Header().Set("Cache-Control", "max-age=60, no-transform")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=60")
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		io.WriteString(rw, body)
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-precompress", "text/", "-compress-min-size", "0")
+	get(t, base+"/a")
+
+	res, _ := get(t, base+"/a", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" || !hasTransformWarning(res) {
+		t.Fatal(fmt.Sprintf("gzipped copy has Warning %q", res.Header.Values("Warning")))
+	}
+
+	if res, _ := get(t, base+"/a"); hasTransformWarning(res) {
+		t.Fatal("the identity body, as the origin sent it, was marked transformed")
+	}
+
+	get(t, base+"/raw")
+	res, _ = get(t, base+"/raw", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "" || hasTransformWarning(res) {
+		t.Fatal("a no-transform response was compressed")
+	}
+}
+
+func TestTransformWarningOnStaleCopies(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Content-Type", "text/plain")
+		io.WriteString(rw, body)
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-precompress", "text/", "-compress-min-size", "0",
+		"-stale-while-revalidate", "30s")
+
+	get(t, base+"/a")
+	age(t, cache, "/a", 70*time.Second)
+
+	res, _ := get(t, base+"/a", "Accept-Encoding", "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" || !hasTransformWarning(res) {
+		t.Fatal(fmt.Sprintf("stale gzipped copy has Warning %q", res.Header.Values("Warning")))
+	}
+
+	if w := res.Header.Values("Warning"); len(w) != 2 {
+		t.Fatal(fmt.Sprintf("stale gzipped copy has Warning %q, want it stale and transformed", w))
+	}
+}
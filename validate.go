@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/sonewman/rox"
+	"log"
+	"net/http"
+	"time"
+)
+
+// checks, once per entry, whether the origin would still
+// send what we're serving as fresh. a difference means
+// something is being cached for longer than it should be
+func startValidation(o *options, cache *Cache, p *rox.Rox, out *http.Request, cr *CachedResponse) {
+	if !cr.validated.CompareAndSwap(false, true) {
+		return
+	}
+
+	bg := out.Clone(context.Background())
+	cache.refresher.submit(func() { validateFreshness(o, p, bg, cr) })
+}
+
+func validateFreshness(o *options, p *rox.Rox, bg *http.Request, cr *CachedResponse) {
+	// against what a fill would have been given
+	res, err := rox.DoRequest(p, tieredRequest(o, bg, false))
+	maybeLog(o, bg)
+
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	if err != nil {
+		log.Println(fmt.Sprintf("failed to validate %s: %s", bg.URL, err))
+		return
+	}
+
+	// put through the same steps as the cached copy was
+	latest := &CachedResponse{}
+	fill(o, bg, latest, res)
+
+	cached := sha256.Sum256(cr.identity())
+	origin := sha256.Sum256(latest.identity())
+
+	if cached == origin {
+		return
+	}
+
+	left := "no expiry"
+	if !cr.Expires.IsZero() {
+		left = fmt.Sprintf("%s of freshness left", cr.Expires.Sub(time.Now()).Round(time.Second))
+	}
+
+	log.Println(fmt.Sprintf("warning: cached %s (%x) differs from origin (%x) with %s", bg.URL, cached[:6], origin[:6], left))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChangedOriginBodyIsReported(t *testing.T) {
+	logged := captureLog(t)
+
+	var version atomic.Int64
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(rw, "v%d", version.Load())
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-validate-freshness")
+	get(t, base+"/page")
+
+	version.Add(1)
+	if _, body := get(t, base+"/page"); body != "v0" {
+		t.Fatal(fmt.Sprintf("hit served %q, want v0", body))
+	}
+
+	waitFor(t, "the mismatch to be logged", 5*time.Second, func() bool {
+		return strings.Contains(logged.String(), "differs from origin")
+	})
+}
+
+func TestUnchangedOriginBodyIsNotReported(t *testing.T) {
+	logged := captureLog(t)
+
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("same"))
+	})
+
+	base, _ := newProxy(t, origin.URL, "-c", "-validate-freshness")
+	get(t, base+"/page")
+	get(t, base+"/page")
+	get(t, base+"/page")
+
+	// the fill, then one validation however many hits
+	waitFor(t, "the validation", 5*time.Second, func() bool {
+		return origin.requests.Load() == 2
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+
+	if strings.Contains(logged.String(), "differs from origin") {
+		t.Fatal(fmt.Sprintf("unchanged body reported: %s", logged))
+	}
+}
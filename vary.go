@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func varies(h http.Header, name string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func addVary(h http.Header, name string) {
+	if !varies(h, name) {
+		h.Add("Vary", name)
+	}
+}
+
+// Vary: Cookie means every client may get something of
+// their own, which a shared cache would hand to everyone
+// else, unless we've been told which cookies matter and
+// are keying on those
+func varyCookieSafe(o *options, cr *CachedResponse) bool {
+	if varies(cr.Header, "*") {
+		return false
+	}
+
+	return !varies(cr.Header, "Cookie") || *o.VaryCookies != ""
+}
+
+func cookieKey(names []string, r *http.Request) string {
+	var s []string
+	for _, name := range names {
+		var value string
+		if c, err := r.Cookie(name); err == nil {
+			value = c.Value
+		}
+
+		s = append(s, name+"="+value)
+	}
+
+	return strings.Join(s, ";")
+}
+
+// -key-headers values, however many times a header was
+// sent and however it was spaced or cased, a header that
+// wasn't sent keys the same as one sent empty
+func headerKey(names []string, r *http.Request) string {
+	var s []string
+	for _, name := range names {
+		var values []string
+		for _, v := range r.Header.Values(name) {
+			for _, part := range strings.Split(v, ",") {
+				if part = strings.Join(strings.Fields(part), " "); part != "" {
+					values = append(values, strings.ToLower(part))
+				}
+			}
+		}
+
+		s = append(s, name+"="+strings.Join(values, ","))
+	}
+
+	return strings.Join(s, ";")
+}
+
+// the fields of every Vary header, deduped, lowercased
+// and sorted so the same set always makes the same key
+// however the origin happens to write it
+func varyFields(h http.Header) []string {
+	seen := make(map[string]bool)
+	var fields []string
+
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.ToLower(strings.TrimSpace(field))
+			if field == "" || seen[field] {
+				continue
+			}
+
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	sort.Strings(fields)
+	return fields
+}
+
+func normalizeVary(h http.Header) {
+	if fields := varyFields(h); fields != nil {
+		h.Set("Vary", strings.Join(fields, ", "))
+	}
+}
+
+// what a URL's variants are keyed on. cookies are keyed
+// by -vary-cookies if at all, and identity and gzip are
+// served from the one entry, so neither splits it here.
+// only a body the origin encoded itself depends on what
+// the client accepts
+func keyedVaryFields(h http.Header) []string {
+	ce := strings.ToLower(h.Get("Content-Encoding"))
+	encoded := ce != "" && ce != "identity"
+
+	var fields []string
+	for _, field := range varyFields(h) {
+		if field == "cookie" || (field == "accept-encoding" && !encoded) {
+			continue
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// the Vary we add for the device class, key headers and
+// claims is for caches further down. we key on the class
+// and the claims rather than every User-Agent and token
+func (c *Cache) uncovered(fields []string) []string {
+	var left []string
+	for _, field := range fields {
+		if !c.covered[field] {
+			left = append(left, field)
+		}
+	}
+
+	return left
+}
+
+func varyKey(fields []string, r *http.Request) string {
+	var s []string
+	for _, name := range fields {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "accept-encoding" {
+			value = normalizeAcceptEncoding(value)
+		}
+
+		s = append(s, name+"="+value)
+	}
+
+	return strings.Join(s, ";")
+}
+
+// "deflate, GZIP;q=0.8" and "gzip, deflate" accept the
+// same codings so make the same key. preference doesn't
+// change what can be served, but q=0 rules a coding out
+func normalizeAcceptEncoding(v string) string {
+	seen := make(map[string]bool)
+	var codings []string
+
+	for _, part := range strings.Split(v, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" || seen[coding] {
+			continue
+		}
+
+		if len(fields) > 1 {
+			q := strings.TrimSpace(fields[1])
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(q, "q="), 64); err == nil && v == 0 {
+				continue
+			}
+		}
+
+		seen[coding] = true
+		codings = append(codings, coding)
+	}
+
+	sort.Strings(codings)
+	return strings.Join(codings, ",")
+}
+
+// a stored response tells us what its URL varies on. if
+// that isn't what we keyed it by, every variant keyed the
+// old way goes and cr moves to the key it should have.
+// returns the key cr is now held under, must be called
+// with the cache lock held
+func (c *Cache) rekey(req *http.Request, key string, cr *CachedResponse) string {
+	if c.vary == nil {
+		return key
+	}
+
+	base := c.baseKey(req)
+	fields := c.uncovered(keyedVaryFields(cr.Header))
+	if strings.Join(fields, ",") == strings.Join(c.vary[base], ",") {
+		return key
+	}
+
+	p := c.pool(req)
+	for k := range c.variants[getKey(req)] {
+		if k == base || strings.HasPrefix(k, base+variantSep) {
+			p.remove(k)
+			delete(c.cache, k)
+			c.untrackVariant(k)
+		}
+	}
+
+	if fields == nil {
+		delete(c.vary, base)
+	} else {
+		c.vary[base] = fields
+	}
+
+	key = c.key(req)
+	c.cache[key] = cr
+	p.add(key)
+	c.trackVariant(key)
+	return key
+}
+
+// keys up to the first separator are the URL's, whatever
+// it varies on
+func baseOf(key string) string {
+	if i := strings.Index(key, variantSep); i >= 0 {
+		return key[:i]
+	}
+
+	return key
+}
+
+// must be called with the cache lock held
+func (c *Cache) trackVariant(key string) {
+	base := baseOf(key)
+	if c.variants[base] == nil {
+		c.variants[base] = make(map[string]bool)
+	}
+
+	c.variants[base][key] = true
+}
+
+// must be called with the cache lock held
+func (c *Cache) untrackVariant(key string) {
+	base := baseOf(key)
+	if keys := c.variants[base]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.variants, base)
+		}
+	}
+}
+
+// keeps the number of variants held for req's URL within
+// -max-variants, dropping the least recently used first
+// but never key, the one just stored. must be called with
+// the cache lock held
+func (c *Cache) limitVariants(req *http.Request, key string) {
+	if c.maxVariants <= 0 {
+		return
+	}
+
+	keys := c.variants[getKey(req)]
+
+	// every variant of a URL shares its path and so its pool
+	p := c.pool(req)
+
+	for len(keys) > c.maxVariants {
+		var oldest string
+		var used time.Time
+
+		for k := range keys {
+			if k == key {
+				continue
+			}
+
+			if el := p.items[k]; el == nil {
+				oldest = k
+				break
+			} else if item := el.Value.(*poolItem); oldest == "" || item.used.Before(used) {
+				oldest, used = k, item.used
+			}
+		}
+
+		if oldest == "" {
+			return
+		}
+
+		p.remove(oldest)
+		delete(c.cache, oldest)
+		c.untrackVariant(oldest)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// greets whoever the session cookie says they are
+func cookieOrigin(t *testing.T) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "Cookie")
+
+		user := "guest"
+		if c, err := r.Cookie("session"); err == nil {
+			user = c.Value
+		}
+		io.WriteString(rw, "hello "+user)
+	})
+}
+
+func TestVaryCookieIsNotCachedByDefault(t *testing.T) {
+	origin := cookieOrigin(t)
+	base, cache := newProxy(t, origin.URL, "-c")
+
+	get(t, base+"/account", "Cookie", "session=alice")
+	if cachedEntry(t, cache, "/account") != nil {
+		t.Fatal("a Vary: Cookie response was cached")
+	}
+
+	if _, body := get(t, base+"/account", "Cookie", "session=bob"); body != "hello bob" {
+		t.Fatal(fmt.Sprintf("bob got %q", body))
+	}
+}
+
+func TestVaryCookiesKeysOnTheNamedCookies(t *testing.T) {
+	origin := cookieOrigin(t)
+	base, _ := newProxy(t, origin.URL, "-c", "-vary-cookies", "session")
+
+	get(t, base+"/account", "Cookie", "session=alice; _ga=1")
+	if _, body := get(t, base+"/account", "Cookie", "session=bob"); body != "hello bob" {
+		t.Fatal(fmt.Sprintf("bob got %q", body))
+	}
+
+	// other cookies aren't part of the key
+	if _, body := get(t, base+"/account", "Cookie", "session=alice; _ga=2"); body != "hello alice" {
+		t.Fatal(fmt.Sprintf("alice got %q", body))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want one per session", n))
+	}
+}
+
+func TestVaryFieldsAreNormalized(t *testing.T) {
+	want := []string{"accept-language", "x-tenant"}
+
+	for _, vary := range [][]string{
+		{"Accept-Language, X-Tenant"},
+		{"x-tenant,accept-language"},
+		{"X-Tenant", "Accept-Language"},
+		{"ACCEPT-LANGUAGE, x-tenant", "X-Tenant , accept-language"},
+	} {
+		h := http.Header{"Vary": vary}
+		if got := varyFields(h); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatal(fmt.Sprintf("Vary %q gave %v, want %v", vary, got, want))
+		}
+	}
+}
+
+func TestReorderedVaryKeepsOneNamespace(t *testing.T) {
+	// each tenant's responses spell Vary their own way
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("X-Tenant") == "a" {
+			rw.Header().Set("Vary", "Accept-Language, X-Tenant")
+		} else {
+			rw.Header().Add("Vary", "x-tenant")
+			rw.Header().Add("Vary", "ACCEPT-LANGUAGE, x-tenant")
+		}
+		io.WriteString(rw, r.Header.Get("X-Tenant")+" "+r.Header.Get("Accept-Language"))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-key-on-vary")
+
+	get(t, base+"/home", "X-Tenant", "a", "Accept-Language", "en")
+	get(t, base+"/home", "X-Tenant", "b", "Accept-Language", "en")
+
+	for _, tenant := range []string{"a", "b"} {
+		if _, body := get(t, base+"/home", "X-Tenant", tenant, "Accept-Language", "en"); body != tenant+" en" {
+			t.Fatal(fmt.Sprintf("tenant %s was served %q", tenant, body))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+
+	entries := cachedEntries(t, cache, "GET", "/home")
+	if len(entries) != 2 {
+		t.Fatal(fmt.Sprintf("%d entries held, want one per tenant", len(entries)))
+	}
+
+	for key, cr := range entries {
+		if got := cr.Header.Values("Vary"); len(got) != 1 || got[0] != "accept-language, x-tenant" {
+			t.Fatal(fmt.Sprintf("held with Vary %q", got))
+		}
+
+		variant := strings.SplitN(key, variantSep, 2)[1]
+		if !strings.HasPrefix(variant, "accept-language=en;x-tenant=") {
+			t.Fatal(fmt.Sprintf("variant keyed as %q", variant))
+		}
+	}
+}
+
+func TestVariantsOverTheCapAreEvictedLRU(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "X-Tenant")
+		io.WriteString(rw, r.Header.Get("X-Tenant"))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-key-on-vary", "-max-variants", "3")
+
+	for _, tenant := range []string{"a", "b", "c", "a", "d"} {
+		get(t, base+"/home", "X-Tenant", tenant)
+	}
+
+	if n := len(cachedEntries(t, cache, "GET", "/home")); n != 3 {
+		t.Fatal(fmt.Sprintf("%d variants held, want the cap of 3", n))
+	}
+
+	// a was used again after b, so b went to make room for d
+	before := origin.requests.Load()
+	for _, tenant := range []string{"a", "c", "d"} {
+		if _, body := get(t, base+"/home", "X-Tenant", tenant); body != tenant {
+			t.Fatal(fmt.Sprintf("tenant %s was served %q", tenant, body))
+		}
+	}
+
+	if n := origin.requests.Load() - before; n != 0 {
+		t.Fatal(fmt.Sprintf("%d of the most recently used variants were evicted", n))
+	}
+
+	get(t, base+"/home", "X-Tenant", "b")
+	if n := origin.requests.Load() - before; n != 1 {
+		t.Fatal("the least recently used variant was kept")
+	}
+}
+
+func TestAcceptEncodingIsNormalized(t *testing.T) {
+	for v, want := range map[string]string{
+		"gzip, deflate":            "deflate,gzip",
+		"deflate, gzip":            "deflate,gzip",
+		"DEFLATE;q=0.5, gzip,gzip": "deflate,gzip",
+		"gzip, deflate;q=0":        "gzip",
+		"gzip;q=0.0":               "",
+		"":                         "",
+	} {
+		if got := normalizeAcceptEncoding(v); got != want {
+			t.Fatal(fmt.Sprintf("%q normalized to %q, want %q", v, got, want))
+		}
+	}
+}
+
+func TestReorderedAcceptEncodingSharesAVariant(t *testing.T) {
+	// encodes the body itself, so what the client accepts
+	// picks the variant
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "Accept-Encoding")
+		rw.Header().Set("Content-Encoding", "x-test")
+		io.WriteString(rw, r.Header.Get("Accept-Encoding"))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-key-on-vary")
+
+	for _, ae := range []string{"gzip, deflate", "deflate, gzip", "DEFLATE;q=0.5, gzip, gzip"} {
+		if _, body := get(t, base+"/a", "Accept-Encoding", ae); body != "gzip, deflate" {
+			t.Fatal(fmt.Sprintf("Accept-Encoding %q was served %q", ae, body))
+		}
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 1", n))
+	}
+
+	// ruling a coding out does accept something different
+	get(t, base+"/a", "Accept-Encoding", "gzip, deflate;q=0")
+	if n := len(cachedEntries(t, cache, "GET", "/a")); n != 2 {
+		t.Fatal(fmt.Sprintf("%d variants held, want 2", n))
+	}
+}
+
+func TestKeyHeadersGiveDistinctEntries(t *testing.T) {
+	origin := newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(rw, "region "+r.Header.Get("X-Region"))
+	})
+
+	base, cache := newProxy(t, origin.URL, "-c", "-key-headers", "X-Region")
+
+	for _, region := range []string{"eu", "us"} {
+		if _, body := get(t, base+"/home", "X-Region", region); body != "region "+region {
+			t.Fatal(fmt.Sprintf("%s was served %q", region, body))
+		}
+	}
+
+	if n := len(cachedEntries(t, cache, "GET", "/home")); n != 2 {
+		t.Fatal(fmt.Sprintf("%d entries held, want one per region", n))
+	}
+
+	// spacing and case don't make another entry
+	if _, body := get(t, base+"/home", "X-Region", " EU "); body != "region eu" {
+		t.Fatal(fmt.Sprintf("EU was served %q", body))
+	}
+
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want 2", n))
+	}
+}
+
+func TestMissingKeyHeaderKeysAsEmpty(t *testing.T) {
+	names := []string{"X-Region"}
+	missing := httptest.NewRequest("GET", "/", nil)
+	empty := httptest.NewRequest("GET", "/", nil)
+	empty.Header.Set("X-Region", "")
+	set := httptest.NewRequest("GET", "/", nil)
+	set.Header.Set("X-Region", "eu")
+
+	if headerKey(names, missing) != headerKey(names, empty) {
+		t.Fatal("a missing header keyed differently to an empty one")
+	}
+
+	if headerKey(names, missing) == headerKey(names, set) {
+		t.Fatal("a missing header keyed the same as one with a value")
+	}
+}
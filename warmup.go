@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -warmup-file lists paths, one per line, requested through
+// the proxy at startup. until they have all been, or
+// -warmup-timeout passes, /_readyz says not ready so a
+// load balancer holds off sending this instance traffic
+type warmup struct {
+	ready  atomic.Bool
+	total  int
+	warmed atomic.Int64
+}
+
+func readWarmupFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			paths = append(paths, line)
+		}
+	}
+
+	return paths, scanner.Err()
+}
+
+func startWarmup(o *options, proxy http.Handler) *warmup {
+	paths, err := readWarmupFile(*o.WarmupFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := &warmup{total: len(paths)}
+
+	go func() {
+		ctx := context.Background()
+		if *o.WarmupTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *o.WarmupTimeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+
+		for _, path := range paths {
+			if ctx.Err() != nil {
+				break
+			}
+
+			pw, err := replayGet(ctx, proxy, path, "")
+			if err != nil {
+				log.Println(fmt.Sprintf("failed to warm %s: %s", path, err))
+			} else if pw.status >= 400 {
+				log.Println(fmt.Sprintf("failed to warm %s: got %d", path, pw.status))
+			}
+
+			w.warmed.Add(1)
+		}
+
+		if ctx.Err() != nil {
+			log.Println(fmt.Sprintf("warmup timed out after %d of %d paths", w.warmed.Load(), w.total))
+		} else {
+			log.Println(fmt.Sprintf("warmed %d paths in %s", w.total, time.Since(start)))
+		}
+
+		w.ready.Store(true)
+	}()
+
+	return w
+}
+
+// answered ahead of everything else and without a token,
+// probes need to reach it and it gives nothing away
+func (w *warmup) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_readyz" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		status := http.StatusServiceUnavailable
+		if w.ready.Load() {
+			status = http.StatusOK
+		}
+
+		writeJSON(rw, status, map[string]interface{}{
+			"ready":  w.ready.Load(),
+			"warmed": w.warmed.Load(),
+			"total":  w.total,
+		})
+	})
+}
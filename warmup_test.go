@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func warmupFile(t *testing.T, paths ...string) string {
+	name := filepath.Join(t.TempDir(), "warmup.txt")
+	content := "# warmed at startup\n" + strings.Join(paths, "\n") + "\n"
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+// holds every request until release is closed
+func heldOrigin(t *testing.T, release chan struct{}) *testOrigin {
+	return newOrigin(t, func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=60")
+	})
+}
+
+func readiness(t *testing.T, base string) int {
+	res, _ := get(t, base+"/_readyz")
+	return res.StatusCode
+}
+
+func TestNotReadyUntilWarmedUp(t *testing.T) {
+	release := make(chan struct{})
+	origin := heldOrigin(t, release)
+	base, _ := newProxy(t, origin.URL, "-c", "-warmup-file", warmupFile(t, "/a", "/b"))
+
+	waitFor(t, "warmup to reach the origin", 5*time.Second, func() bool {
+		return origin.requests.Load() > 0
+	})
+
+	if status := readiness(t, base); status != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Sprintf("readiness was %d during warmup, want 503", status))
+	}
+
+	close(release)
+	waitFor(t, "readiness", 5*time.Second, func() bool {
+		return readiness(t, base) == http.StatusOK
+	})
+
+	get(t, base+"/a")
+	get(t, base+"/b")
+	if n := origin.requests.Load(); n != 2 {
+		t.Fatal(fmt.Sprintf("origin saw %d requests, want the warmed paths to be hits", n))
+	}
+}
+
+func TestReadyAfterWarmupTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	origin := heldOrigin(t, release)
+	base, _ := newProxy(t, origin.URL, "-c",
+		"-warmup-file", warmupFile(t, "/a", "/b"),
+		"-warmup-timeout", "100ms")
+
+	if status := readiness(t, base); status != http.StatusServiceUnavailable {
+		t.Fatal(fmt.Sprintf("readiness was %d during warmup, want 503", status))
+	}
+
+	waitFor(t, "readiness", 5*time.Second, func() bool {
+		return readiness(t, base) == http.StatusOK
+	})
+}